@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
@@ -61,60 +64,19 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 初回登録キャンペーンのクーポンを付与
-	_, err = tx.ExecContext(
-		ctx,
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert coupon: %w", err))
+	if err := issueCoupon(ctx, tx, userID, "CP_NEW2024", 3000, couponDefinitionNew2024); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	// 招待コードを使った登録
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to select coupon: %w", err))
-			return
-		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
-
-		// ユーザーチェック
-		var inviter User
-		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+		if err := acceptInvitation(ctx, tx, userID, *req.InvitationCode); err != nil {
+			if errors.Is(err, errInvitationCodeUnavailable) {
+				writeError(w, http.StatusBadRequest, err)
 				return
 			}
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to select user: %w", err))
-			return
-		}
-
-		// 招待クーポン付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert coupon: %w", err))
-			return
-		}
-		// 招待した人にもRewardを付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert coupon: %w", err))
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	}
@@ -154,20 +116,315 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 	user := ctx.Value("user").(*User)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var registered int
+	if err := tx.GetContext(ctx, &registered, `SELECT COUNT(*) FROM payment_tokens WHERE user_id = ? FOR UPDATE`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 最初に登録した決済手段を既定にする
+	_, err = tx.ExecContext(
 		ctx,
-		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
+		`INSERT INTO payment_tokens (id, user_id, token, is_default) VALUES (?, ?, ?, ?)`,
+		ulid.Make().String(),
 		user.ID,
 		req.Token,
+		registered == 0,
 	)
 	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			writeError(w, http.StatusConflict, errors.New("payment token already registered"))
+			return
+		}
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert payment token: %w", err))
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// selectPaymentTokens はユーザーの決済手段を試す順(既定のもの、登録日時の古いもの)に返す
+func selectPaymentTokens(ctx context.Context, q sqlx.QueryerContext, userID string) ([]PaymentToken, error) {
+	tokens := []PaymentToken{}
+	if err := sqlx.SelectContext(ctx, q, &tokens, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, created_at, id`, userID); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// hasPaymentToken はユーザーが決済手段を1つ以上登録しているかを返す
+func hasPaymentToken(ctx context.Context, q sqlx.QueryerContext, userID string) (bool, error) {
+	var exists bool
+	if err := sqlx.GetContext(ctx, q, &exists, `SELECT EXISTS (SELECT 1 FROM payment_tokens WHERE user_id = ?)`, userID); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+type appGetPaymentMethodsResponse struct {
+	PaymentMethods []appGetPaymentMethodsResponseItem `json:"payment_methods"`
+}
+
+type appGetPaymentMethodsResponseItem struct {
+	ID        string `json:"id"`
+	Token     string `json:"token"`
+	IsDefault bool   `json:"is_default"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// maskPaymentToken は決済トークンの末尾4文字以外を伏せる
+func maskPaymentToken(token string) string {
+	if len(token) <= 4 {
+		return strings.Repeat("*", len(token))
+	}
+	return strings.Repeat("*", len(token)-4) + token[len(token)-4:]
+}
+
+func appGetPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	tokens, err := selectPaymentTokens(ctx, db, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]appGetPaymentMethodsResponseItem, 0, len(tokens))
+	for _, t := range tokens {
+		items = append(items, appGetPaymentMethodsResponseItem{
+			ID:        t.ID,
+			Token:     maskPaymentToken(t.Token),
+			IsDefault: t.IsDefault,
+			CreatedAt: t.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetPaymentMethodsResponse{
+		PaymentMethods: items,
+	})
+}
+
+func appPostPaymentMethodDefault(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	paymentMethodID := r.PathValue("payment_method_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	tokens := []PaymentToken{}
+	if err := tx.SelectContext(ctx, &tokens, `SELECT * FROM payment_tokens WHERE user_id = ? FOR UPDATE`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !slices.ContainsFunc(tokens, func(t PaymentToken) bool { return t.ID == paymentMethodID }) {
+		writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE payment_tokens SET is_default = (id = ?) WHERE user_id = ?`, paymentMethodID, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func appDeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	paymentMethodID := r.PathValue("payment_method_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	token := &PaymentToken{}
+	if err := tx.GetContext(ctx, token, `SELECT * FROM payment_tokens WHERE id = ? AND user_id = ? FOR UPDATE`, paymentMethodID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM payment_tokens WHERE id = ?`, token.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 既定の決済手段を削除した場合は、残っているうち最も古いものを既定にする
+	if token.IsDefault {
+		if _, err := tx.ExecContext(ctx, `UPDATE payment_tokens SET is_default = 1 WHERE user_id = ? ORDER BY created_at, id LIMIT 1`, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type appGetCouponsResponse struct {
+	Available []appGetCouponsResponseItem `json:"available"`
+	Used      []appGetCouponsResponseItem `json:"used"`
+	Expired   []appGetCouponsResponseItem `json:"expired"`
+}
+
+type appGetCouponsResponseItem struct {
+	Code        string  `json:"code"`
+	Discount    int     `json:"discount"`
+	Description string  `json:"description"`
+	RideID      *string `json:"ride_id,omitempty"`
+	CreatedAt   int64   `json:"created_at"`
+	ExpiresAt   *int64  `json:"expires_at,omitempty"`
+}
+
+func appGetCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	type couponWithDescription struct {
+		Coupon
+		Description sql.NullString `db:"description"`
+	}
+	coupons := []couponWithDescription{}
+	if err := db.SelectContext(
+		ctx,
+		&coupons,
+		`SELECT coupons.*, coupon_definitions.description FROM coupons
+		LEFT JOIN coupon_definitions ON coupon_definitions.name = coupons.definition
+		WHERE coupons.user_id = ? ORDER BY coupons.created_at, coupons.code`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &appGetCouponsResponse{
+		Available: []appGetCouponsResponseItem{},
+		Used:      []appGetCouponsResponseItem{},
+		Expired:   []appGetCouponsResponseItem{},
+	}
+	now := time.Now()
+	for _, c := range coupons {
+		item := appGetCouponsResponseItem{
+			Code:        c.Code,
+			Discount:    c.Discount,
+			Description: c.Description.String,
+			RideID:      c.UsedBy,
+			CreatedAt:   c.CreatedAt.UnixMilli(),
+		}
+		if c.ExpiresAt != nil {
+			expiresAt := c.ExpiresAt.UnixMilli()
+			item.ExpiresAt = &expiresAt
+		}
+
+		switch {
+		case c.UsedBy != nil:
+			res.Used = append(res.Used, item)
+		case c.ExpiredAt != nil || (c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)):
+			// CouponSweeper が処理する前でも期限を過ぎていれば期限切れとして扱う
+			res.Expired = append(res.Expired, item)
+		default:
+			res.Available = append(res.Available, item)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type appGetInvitationsResponse struct {
+	InvitationCode string                          `json:"invitation_code"`
+	Config         ReferralConfig                  `json:"config"`
+	Used           int                             `json:"used"`
+	Remaining      int                             `json:"remaining"`
+	TotalReward    int                             `json:"total_reward"`
+	Invitations    []appGetInvitationsResponseItem `json:"invitations"`
+}
+
+type appGetInvitationsResponseItem struct {
+	InvitedAt    int64   `json:"invited_at"`
+	Rewarded     bool    `json:"rewarded"`
+	RewardAmount int     `json:"reward_amount"`
+	RewardCode   *string `json:"reward_code,omitempty"`
+	RewardedAt   *int64  `json:"rewarded_at,omitempty"`
+}
+
+func appGetInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	config, err := loadReferralConfig(ctx, db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	invitations := []Invitation{}
+	if err := db.SelectContext(ctx, &invitations, `SELECT * FROM invitations WHERE inviter_id = ? ORDER BY created_at`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &appGetInvitationsResponse{
+		InvitationCode: user.InvitationCode,
+		Config:         *config,
+		Used:           len(invitations),
+		Remaining:      max(config.MaxInvites-len(invitations), 0),
+		Invitations:    make([]appGetInvitationsResponseItem, 0, len(invitations)),
+	}
+	for _, inv := range invitations {
+		item := appGetInvitationsResponseItem{
+			InvitedAt:  inv.CreatedAt.UnixMilli(),
+			Rewarded:   inv.RewardedAt != nil,
+			RewardCode: inv.RewardCode,
+		}
+		if inv.RewardAmount != nil {
+			item.RewardAmount = *inv.RewardAmount
+			res.TotalReward += *inv.RewardAmount
+		}
+		if inv.RewardedAt != nil {
+			rewardedAt := inv.RewardedAt.UnixMilli()
+			item.RewardedAt = &rewardedAt
+		}
+		res.Invitations = append(res.Invitations, item)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
 }
@@ -178,11 +435,34 @@ type getAppRidesResponseItem struct {
 	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
+	FareBreakdown         fareBreakdown                `json:"fare_breakdown"`
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
 }
 
+type fareBreakdown struct {
+	BaseFare        int     `json:"base_fare"`
+	MeteredFare     int     `json:"metered_fare"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	CouponCode      *string `json:"coupon_code"`
+	CouponDiscount  int     `json:"coupon_discount"`
+	FinalFare       int     `json:"final_fare"`
+	Currency        string  `json:"currency"`
+}
+
+func newFareBreakdown(fare *RideFare) fareBreakdown {
+	return fareBreakdown{
+		BaseFare:        fare.BaseFare,
+		MeteredFare:     fare.MeteredFare,
+		SurgeMultiplier: fare.SurgeMultiplier,
+		CouponCode:      fare.CouponCode,
+		CouponDiscount:  fare.CouponDiscount,
+		FinalFare:       fare.FinalFare,
+		Currency:        fare.Currency,
+	}
+}
+
 type getAppRidesResponseItemChair struct {
 	ID    string `json:"id"`
 	Owner string `json:"owner"`
@@ -239,7 +519,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	completedRideIDs := []string{}
 	for _, ride := range rides {
 		status, exists := latestStatuses[ride.ID]
-		if exists && status == "COMPLETED" {
+		if exists && status == RideStatusCompleted {
 			completedRides = append(completedRides, ride)
 			completedRideIDs = append(completedRideIDs, ride.ID)
 		}
@@ -309,20 +589,23 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		ownerMap[owner.ID] = owner
 	}
 
-	// 9. レスポンス用のアイテムを作成
+	// 9. 運賃の内訳を一括で取得
+	fares, err := selectRideFares(ctx, tx, completedRides)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride fares: %w", err))
+		return
+	}
+
+	// 10. レスポンス用のアイテムを作成
 	items := make([]getAppRidesResponseItem, 0, len(completedRides))
 	for _, ride := range completedRides {
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to calculate discounted fare: %w", err))
-			return
-		}
-
+		fare := fares[ride.ID]
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
+			Fare:                  fare.FinalFare,
+			FareBreakdown:         newFareBreakdown(fare),
 			Evaluation:            *ride.Evaluation,
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
 			CompletedAt:           ride.UpdatedAt.UnixMilli(),
@@ -398,89 +681,12 @@ func getLatestRideStatuses(ctx context.Context, tx *sqlx.Tx, rideIDs []string) (
 	return statusMap, nil
 }
 
-func appGetRidesOld(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := ctx.Value("user").(*User)
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err))
-		return
-	}
-	defer tx.Rollback()
-
-	rides := []Ride{}
-	if err := tx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC`,
-		user.ID,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to select rides: %w", err))
-		return
-	}
-
-	items := []getAppRidesResponseItem{}
-	for _, ride := range rides {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get latest ride status: %w", err))
-			return
-		}
-		if status != "COMPLETED" {
-			continue
-		}
-
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to calculate discounted fare: %w", err))
-			return
-		}
-
-		item := getAppRidesResponseItem{
-			ID:                    ride.ID,
-			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
-			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
-			Evaluation:            *ride.Evaluation,
-			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
-		}
-
-		item.Chair = getAppRidesResponseItemChair{}
-
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get chair: %w", err))
-			return
-		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
-
-		owner := &Owner{}
-		if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get owner: %w", err))
-			return
-		}
-		item.Chair.Owner = owner.Name
-
-		items = append(items, item)
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
-	})
-}
-
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// QuoteID は運賃を確定させる見積もり。省略した場合はその場で見積もる
+	QuoteID *string `json:"quote_id"`
+	Tier    *string `json:"tier"`
 }
 
 type appPostRidesResponse struct {
@@ -543,7 +749,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	continuingRideCount := 0
 	for _, ride := range rides {
 		status, exists := latestStatuses[ride.ID]
-		if exists && status != "COMPLETED" {
+		if exists && !rideStateMachine.IsTerminal(status) {
 			continuingRideCount++
 		}
 	}
@@ -553,7 +759,19 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := tx.ExecContext(
+	quoteID := ""
+	if req.QuoteID != nil {
+		quoteID = *req.QuoteID
+	} else {
+		quote, err := pricer.Quote(ctx, tx, user.ID, req.Tier, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+		if err != nil {
+			writePriceQuoteError(w, err)
+			return
+		}
+		quoteID = quote.ID
+	}
+
+	if _, err := tx.ExecContext(
 		ctx,
 		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
 				  VALUES (?, ?, ?, ?, ?, ?)`,
@@ -563,72 +781,33 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	transition, err := rideStateMachine.Transition(ctx, tx, rideID, RideStatusMatching)
+	if err != nil {
+		writeRideTransitionError(w, err)
 		return
 	}
 
-	var rideCount int
-	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	// 見積もりの運賃でライドの運賃を確定する
+	quote, err := pricer.Lock(ctx, tx, quoteID, user.ID, rideID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	if err != nil {
+		writePriceQuoteError(w, err)
 		return
 	}
 
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx.ExecContext(
-					ctx,
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
+	// 適用できるクーポンのうち最も割引額が大きいものを使う
+	coupon, _, err := selectBestCoupon(ctx, tx, user.ID, rideID, quote.Fare, quote.MeteredFare, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if coupon != nil {
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+			rideID, user.ID, coupon.Code,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
 		}
 	}
 
@@ -638,7 +817,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	fare, err := saveRideFare(ctx, tx, &ride, false)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -648,21 +827,31 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	publishRideEvent(&RideEvent{
+		StatusID: transition.StatusID,
+		RideID:   rideID,
+		UserID:   user.ID,
+		Status:   transition.To,
+	})
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
 		RideID: rideID,
-		Fare:   fare,
+		Fare:   fare.FinalFare,
 	})
 }
 
 type appPostRidesEstimatedFareRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	Tier                  *string     `json:"tier"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
-	Fare     int `json:"fare"`
-	Discount int `json:"discount"`
+	Fare            int     `json:"fare"`
+	Discount        int     `json:"discount"`
+	QuoteID         string  `json:"quote_id"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	ExpiresAt       int64   `json:"expires_at"`
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -686,7 +875,14 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	quote, err := pricer.Quote(ctx, tx, user.ID, req.Tier, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	if err != nil {
+		writePriceQuoteError(w, err)
+		return
+	}
+
+	// ライドの作成時に選ばれるクーポンで割引額を求める
+	_, discount, err := selectBestCoupon(ctx, tx, user.ID, "", quote.Fare, quote.MeteredFare, false)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -698,8 +894,11 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Fare:            quote.Fare - discount,
+		Discount:        discount,
+		QuoteID:         quote.ID,
+		SurgeMultiplier: quote.SurgeMultiplier,
+		ExpiresAt:       quote.ExpiresAt.UnixMilli(),
 	})
 }
 
@@ -744,7 +943,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -752,20 +951,17 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	status, err := getLatestRideStatus(ctx, tx, ride.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+	transition, err := rideStateMachine.Transition(ctx, tx, ride.ID, RideStatusCompleted)
+	if err != nil {
+		writeRideTransitionError(w, err)
 		return
 	}
 
+	// 売上を計上するオーナーを記録しておき、後で椅子が譲渡されても計上先が変わらないようにする
 	result, err := tx.ExecContext(
 		ctx,
-		`UPDATE rides SET evaluation = ? WHERE id = ?`,
+		`UPDATE rides SET evaluation = ?, owner_id = (SELECT owner_id FROM chairs WHERE chairs.id = rides.chair_id) WHERE id = ?`,
 		req.Evaluation, rideID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -779,60 +975,147 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if ok, err := hasPaymentToken(ctx, tx, ride.UserID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
+		return
+	}
+
+	// 運賃を確定させる
+	fare, err := saveRideFare(ctx, tx, ride, true)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+	// 決済はコミット後にPaymentWorkerが非同期に行う
+	// ここでは決済要求を記録するだけなので、サーキットブレーカーが開いていても失敗しない(PaymentWorkerが後で配信し直す)
+	if err := enqueuePayment(ctx, tx, ride, fare.FinalFare); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if ride.ChairID.Valid && ride.OwnerID.Valid {
+		if err := recordChairSales(ctx, tx, ride.OwnerID.String, ride.ChairID.String, ride.UpdatedAt, fare.FinalFare, 1, ride.Evaluation); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+	}
+
+	// 招待されたユーザーの初めてのライドが完了したら、招待した側に特典を付与する
+	if err := rewardReferralOnFirstRide(ctx, tx, ride.UserID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	paymentWorker.Notify()
+	if ride.ChairID.Valid {
+		chairStateIndex.SetRideStatus(ride.ChairID.String, ride.ID, transition.To)
+	}
+	publishRideEvent(&RideEvent{
+		StatusID: transition.StatusID,
+		RideID:   ride.ID,
+		UserID:   ride.UserID,
+		ChairID:  ride.ChairID.String,
+		Status:   transition.To,
+	})
+
+	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	})
+}
+
+type appPostRideCancelResponse struct {
+	Fee        int   `json:"fee"`
+	CanceledAt int64 `json:"canceled_at"`
+}
+
+// appPostRideCancel はユーザーがライドをキャンセルする
+// 乗車前であればキャンセルでき、椅子が配車位置に向かい始めた後はキャンセル料を決済する
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
 
-	paymentToken := &PaymentToken{}
-	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	transition, err := rideStateMachine.Transition(ctx, tx, ride.ID, RideStatusCanceled)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeRideTransitionError(w, err)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
+
+	fee := 0
+	if transition.From == RideStatusEnroute || transition.From == RideStatusPickup {
+		fee = cancellationFee
 	}
 
-	var paymentGatewayURL string
-	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_cancellations (ride_id, fee) VALUES (?, ?)`, ride.ID, fee); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
+	// 適用していたクーポンは再び使えるようにする
+	if _, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := finalizeCanceledRideFare(ctx, tx, ride.ID, fee); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if fee > 0 {
+		if ok, err := hasPaymentToken(ctx, tx, ride.UserID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
+			return
 		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
+
+		if err := enqueuePayment(ctx, tx, ride, fee); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+	}
+
+	cancellation := &RideCancellation{}
+	if err := tx.GetContext(ctx, cancellation, `SELECT * FROM ride_cancellations WHERE ride_id = ?`, ride.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -841,9 +1124,23 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if fee > 0 {
+		paymentWorker.Notify()
+	}
+	if ride.ChairID.Valid {
+		chairStateIndex.SetRideStatus(ride.ChairID.String, ride.ID, transition.To)
+	}
+	publishRideEvent(&RideEvent{
+		StatusID: transition.StatusID,
+		RideID:   ride.ID,
+		UserID:   ride.UserID,
+		ChairID:  ride.ChairID.String,
+		Status:   transition.To,
+	})
 
-	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
-		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	writeJSON(w, http.StatusOK, &appPostRideCancelResponse{
+		Fee:        fee,
+		CanceledAt: cancellation.CreatedAt.UnixMilli(),
 	})
 }
 
@@ -876,35 +1173,165 @@ type appGetNotificationResponseChairStats struct {
 }
 
 func appGetNotification(w http.ResponseWriter, r *http.Request) {
+	if wantsJSONNotification(r) {
+		appGetNotificationLongPoll(w, r)
+		return
+	}
+
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	// SSE用のヘッダー設定
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	// DBを読む前に購読を開始し、その間に発生したステータス変更を取りこぼさないようにする
+	events, unsubscribe := userNotificationHub.Subscribe(user.ID)
+	defer unsubscribe()
 
-	// SSEの接続がクローズされた場合の処理
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		writeError(w, http.StatusInternalServerError, errors.New("failed to cast response writer"))
-		return
+	// Last-Event-ID があればそれ以降のステータスを全て再送する
+	initialStatuses := []RideStatus{}
+	found := false
+	if id := lastEventID(r); id != "" {
+		var err error
+		initialStatuses, found, err = selectRideStatusesAfter(ctx, id, "r.user_id = ?", user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 	}
 
-	tx, err := db.Beginx()
+	// 無ければ最新のライドの未送信ステータスを古い順に取得。全て送信済みなら最新のステータスだけを送る
+	if !found {
+		ride := &Ride{}
+		if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			if err := db.SelectContext(ctx, &initialStatuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at`, ride.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if len(initialStatuses) == 0 {
+				latest := RideStatus{}
+				if err := db.GetContext(ctx, &latest, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+				initialStatuses = append(initialStatuses, latest)
+			}
+		}
+	}
+
+	stream, err := newSSEWriter(w)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
 
-	// 最新のライドを取得
+	sent := map[string]struct{}{}
+	for _, status := range initialStatuses {
+		if err := sendAppRideStatus(ctx, stream, status.RideID, status.ID, status.Status); err != nil {
+			slog.Error("failed to send notification", "error", err)
+			return
+		}
+		sent[status.ID] = struct{}{}
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// 以降はステータスが変わるたびに通知する
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// 受信が追いつかなかったので切断し、再接続で未送信分から再開させる
+				return
+			}
+			if _, ok := sent[event.StatusID]; ok && event.StatusID != "" {
+				continue
+			}
+			if err := sendAppRideStatus(ctx, stream, event.RideID, event.StatusID, event.Status); err != nil {
+				slog.Error("failed to send notification", "error", err)
+				return
+			}
+			if event.StatusID != "" {
+				sent[event.StatusID] = struct{}{}
+			}
+		case <-heartbeat.C:
+			if err := stream.Heartbeat(); err != nil {
+				return
+			}
+		case <-ctx.Done(): // 接続終了時
+			return
+		}
+	}
+}
+
+// appGetNotificationLongPoll はSSEを使えないクライアント向けに、未送信のステータスが発生するか
+// タイムアウトするまで待ってからJSONで返す
+func appGetNotificationLongPoll(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	events, unsubscribe := userNotificationHub.Subscribe(user.ID)
+	defer unsubscribe()
+
+	timeout := time.NewTimer(notificationLongPollTimeout)
+	defer timeout.Stop()
+
+	for {
+		status := &RideStatus{}
+		err := db.GetContext(ctx, status, `
+			SELECT rs.*
+			FROM ride_statuses rs
+			WHERE rs.ride_id = (SELECT id FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1)
+			AND rs.app_sent_at IS NULL
+			ORDER BY rs.created_at
+			LIMIT 1
+		`, user.ID)
+		if err == nil {
+			response, err := buildAppNotification(ctx, status.RideID, status.Status)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, status.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		select {
+		case event, ok := <-events:
+			// 椅子の割り当てはステータス行を伴わないので、現在の状態をそのまま返す
+			if !ok || event.StatusID == "" {
+				writeAppCurrentNotification(w, r, user.ID)
+				return
+			}
+		case <-timeout.C:
+			writeAppCurrentNotification(w, r, user.ID)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeAppCurrentNotification はユーザーの最新のライドの現在の状態をJSONで返す
+func writeAppCurrentNotification(w http.ResponseWriter, r *http.Request, userID string) {
+	ctx := r.Context()
+
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, userID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
-				RetryAfterMs: 30,
+				RetryAfterMs: notificationRetryAfterMs(),
 			})
 			return
 		}
@@ -912,18 +1339,64 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 最初の通知送信（最新のライド状態）
-	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	status, err := getLatestRideStatus(ctx, db, ride.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	response, err := buildAppNotification(ctx, ride.ID, status)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sendAppRideStatus はライドの状態を椅子の情報とともにユーザーへ送信し、送信済みとして記録する
+// 椅子の割り当てのようにステータス行を伴わない通知は、そのライドの最新ステータスのIDで送る
+func sendAppRideStatus(ctx context.Context, stream *sseWriter, rideID, statusID, status string) error {
+	response, err := buildAppNotification(ctx, rideID, status)
+	if err != nil {
+		return err
+	}
+
+	eventID := statusID
+	if eventID == "" {
+		if err := db.GetContext(ctx, &eventID, `SELECT id FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.Send(eventID, response); err != nil {
+		return err
+	}
+
+	if statusID != "" {
+		if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, statusID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildAppNotification はユーザー向け通知の内容を組み立てる
+func buildAppNotification(ctx context.Context, rideID, status string) (*appGetNotificationResponse, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		return nil, err
+	}
+
+	fare, err := selectRideFare(ctx, tx, ride)
+	if err != nil {
+		return nil, err
+	}
 
 	response := &appGetNotificationResponse{
 		Data: &appGetNotificationResponseData{
@@ -936,49 +1409,38 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				Latitude:  ride.DestinationLatitude,
 				Longitude: ride.DestinationLongitude,
 			},
-			Fare:      fare,
+			Fare:      fare.FinalFare,
 			Status:    status,
 			CreatedAt: ride.CreatedAt.UnixMilli(),
 			UpdateAt:  ride.UpdatedAt.UnixMilli(),
 		},
-		RetryAfterMs: 30,
-	}
-
-	// 最初の通知メッセージ送信
-	sendUserSSEMessage(w, response)
-	flusher.Flush() // 最初の通知後にフラッシュする
-
-	// ライド状態の変化を監視
-	// 定期的にライドの状態をチェックして、変更があれば通知する
-	go func() {
-		ticker := time.NewTicker(30 * time.Second) // 定期的にチェック
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				// 状態が変わった場合のみ通知
-				updatedStatus, err := getLatestRideStatus(ctx, tx, ride.ID)
-				if err != nil {
-					// エラーがあれば適切に通知
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
+		RetryAfterMs: notificationRetryAfterMs(),
+	}
+
+	if ride.ChairID.Valid {
+		chair := &Chair{}
+		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+			return nil, err
+		}
 
-				if updatedStatus != status {
-					// 新しい状態を通知
-					status = updatedStatus
+		stats, err := getChairStats(ctx, tx, chair.ID)
+		if err != nil {
+			return nil, err
+		}
 
-					// レスポンスに状態を更新して通知
-					response.Data.Status = status
-					sendUserSSEMessage(w, response)
-					flusher.Flush() // 通知後にフラッシュ
-				}
-			case <-r.Context().Done(): // 接続終了時
-				return
-			}
+		response.Data.Chair = &appGetNotificationResponseChair{
+			ID:    chair.ID,
+			Name:  chair.Name,
+			Model: chair.Model,
+			Stats: stats,
 		}
-	}()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return response, nil
 }
 
 func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
@@ -1012,12 +1474,12 @@ func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNoti
 		var arrivedAt, pickupedAt *time.Time
 		var isCompleted bool
 		for _, status := range rideStatuses {
-			if status.Status == "ARRIVED" {
+			if status.Status == RideStatusArrived {
 				arrivedAt = &status.CreatedAt
-			} else if status.Status == "CARRYING" {
+			} else if status.Status == RideStatusCarrying {
 				pickupedAt = &status.CreatedAt
 			}
-			if status.Status == "COMPLETED" {
+			if status.Status == RideStatusCompleted {
 				isCompleted = true
 			}
 		}
@@ -1053,7 +1515,6 @@ type appGetNearbyChairsResponseChair struct {
 }
 
 func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
 	latStr := r.URL.Query().Get("latitude")
 	lonStr := r.URL.Query().Get("longitude")
 	distanceStr := r.URL.Query().Get("distance")
@@ -1085,150 +1546,23 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	// Fetch all active chairs
-	chairs := []Chair{}
-	err = tx.SelectContext(
-		ctx,
-		&chairs,
-		`SELECT * FROM chairs WHERE is_active = TRUE`,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// Collect chair IDs for batch querying rides and locations
-	chairIDs := []string{}
-	for _, chair := range chairs {
-		chairIDs = append(chairIDs, chair.ID) // Chair ID is a string now
-	}
-
-	// Fetch all rides for the collected chair IDs
-	rides := []*Ride{}
-	query, args, err := sqlx.In(
-		`SELECT * FROM rides WHERE chair_id IN (?) ORDER BY created_at DESC`,
-		chairIDs,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// Rebind for the proper SQL placeholder format
-	query = tx.Rebind(query)
-
-	err = tx.SelectContext(
-		ctx,
-		&rides,
-		query,
-		args...,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// Map rides by chair ID (now as a string)
-	chairRides := make(map[string][]*Ride)
-	for _, ride := range rides {
-		if ride.ChairID.Valid {
-			chairID := ride.ChairID.String
-			chairRides[chairID] = append(chairRides[chairID], ride)
-		}
-	}
-
-	// Fetch the latest chair locations for the collected chair IDs
-	chairLocations := []*ChairLocation{}
-	query, args, err = sqlx.In(
-		`SELECT * FROM chair_locations WHERE chair_id IN (?) ORDER BY created_at DESC`,
-		chairIDs,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// Rebind for the proper SQL placeholder format
-	query = tx.Rebind(query)
-
-	err = tx.SelectContext(
-		ctx,
-		&chairLocations,
-		query,
-		args...,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// Map locations by chair ID (as a string)
-	chairLocationsMap := make(map[string]*ChairLocation)
-	for _, location := range chairLocations {
-		chairLocationsMap[location.ChairID] = location
-	}
-
-	// Filter and process nearby chairs
+	// 椅子の状態はインデックスから取得する
 	nearbyChairs := []appGetNearbyChairsResponseChair{}
-	for _, chair := range chairs {
-		// Skip chairs that have uncompleted rides
-		ridesForChair := chairRides[chair.ID]
-		skip := false
-		for _, ride := range ridesForChair {
-			status, err := getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-			if status != "COMPLETED" {
-				skip = true
-				break
-			}
-		}
-		if skip {
-			continue
-		}
-
-		// Get the latest location for the chair
-		chairLocation, exists := chairLocationsMap[chair.ID]
-		if !exists || calculateDistance(coordinate.Latitude, coordinate.Longitude, chairLocation.Latitude, chairLocation.Longitude) > distance {
-			continue
-		}
-
-		// Append the chair to the response
+	for _, chair := range chairStateIndex.NearbyFreeChairs(coordinate.Latitude, coordinate.Longitude, distance) {
 		nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Model: chair.Model,
 			CurrentCoordinate: Coordinate{
-				Latitude:  chairLocation.Latitude,
-				Longitude: chairLocation.Longitude,
+				Latitude:  chair.Latitude,
+				Longitude: chair.Longitude,
 			},
 		})
 	}
 
-	// Get the current timestamp
-	retrievedAt := &time.Time{}
-	err = tx.GetContext(
-		ctx,
-		retrievedAt,
-		`SELECT CURRENT_TIMESTAMP(6)`,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
 		Chairs:      nearbyChairs,
-		RetrievedAt: retrievedAt.UnixMilli(),
+		RetrievedAt: time.Now().UnixMilli(),
 	})
 }
 
@@ -1236,60 +1570,3 @@ func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude
 	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
 	return initialFare + meteredFare
 }
-
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
-}
-
-// sendUserSSEMessageは、SSEメッセージをクライアントに送信します
-func sendUserSSEMessage(w http.ResponseWriter, response *appGetNotificationResponse) {
-	// SSEメッセージを送信
-	jsonData, err := json.Marshal(response)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// SSEフォーマットで送信
-	fmt.Fprintf(w, "data: %s\n\n", jsonData)
-	w.(http.Flusher).Flush()
-}
@@ -0,0 +1,99 @@
+package main
+
+// chairGridCellSize はグリッドの1セルの幅(緯度・経度の整数座標単位)
+const chairGridCellSize = 16
+
+type gridCell struct {
+	x int
+	y int
+}
+
+// chairGrid は座標空間を一様なグリッドに分割し、セルごとに椅子IDを保持する空間インデックス
+// 同期は呼び出し側(ChairStateIndex)で行う
+type chairGrid struct {
+	cellSize int
+	cells    map[gridCell]map[string]struct{}
+	located  map[string]gridCell
+}
+
+func newChairGrid(cellSize int) *chairGrid {
+	return &chairGrid{
+		cellSize: cellSize,
+		cells:    map[gridCell]map[string]struct{}{},
+		located:  map[string]gridCell{},
+	}
+}
+
+func (g *chairGrid) cellOf(latitude, longitude int) gridCell {
+	return gridCell{x: floorDiv(latitude, g.cellSize), y: floorDiv(longitude, g.cellSize)}
+}
+
+// put は椅子を指定座標のセルに登録する。既に登録済みなら移動させる
+func (g *chairGrid) put(id string, latitude, longitude int) {
+	cell := g.cellOf(latitude, longitude)
+	if prev, ok := g.located[id]; ok {
+		if prev == cell {
+			return
+		}
+		g.remove(id)
+	}
+
+	ids, ok := g.cells[cell]
+	if !ok {
+		ids = map[string]struct{}{}
+		g.cells[cell] = ids
+	}
+	ids[id] = struct{}{}
+	g.located[id] = cell
+}
+
+// remove は椅子をグリッドから取り除く
+func (g *chairGrid) remove(id string) {
+	cell, ok := g.located[id]
+	if !ok {
+		return
+	}
+	delete(g.located, id)
+
+	ids := g.cells[cell]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(g.cells, cell)
+	}
+}
+
+// within は (latitude, longitude) からマンハッタン距離 distance の範囲を含むセルにいる椅子IDを列挙する
+// 厳密な距離の判定は呼び出し側で行う
+func (g *chairGrid) within(latitude, longitude, distance int, fn func(id string)) {
+	minCell := g.cellOf(latitude-distance, longitude-distance)
+	maxCell := g.cellOf(latitude+distance, longitude+distance)
+
+	// 範囲が広すぎる場合は空のセルを走査しないよう、登録済みのセルを直接見る
+	if (maxCell.x-minCell.x+1)*(maxCell.y-minCell.y+1) > len(g.cells) {
+		for cell, ids := range g.cells {
+			if cell.x < minCell.x || cell.x > maxCell.x || cell.y < minCell.y || cell.y > maxCell.y {
+				continue
+			}
+			for id := range ids {
+				fn(id)
+			}
+		}
+		return
+	}
+
+	for x := minCell.x; x <= maxCell.x; x++ {
+		for y := minCell.y; y <= maxCell.y; y++ {
+			for id := range g.cells[gridCell{x: x, y: y}] {
+				fn(id)
+			}
+		}
+	}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -34,32 +35,50 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
-			return
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err))
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := useChairRegisterToken(ctx, tx, req.ChairRegisterToken, req.Model)
+	if err != nil {
+		switch {
+		case errors.Is(err, errChairRegisterTokenInvalid):
+			writeError(w, http.StatusUnauthorized, err)
+		case errors.Is(err, errChairModelNotAllowed):
+			writeError(w, http.StatusForbidden, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
 		}
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get owner: %w", err))
 		return
 	}
 
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 
-	err := chairRepo.InsertChair(ctx, &Chair{
-		ID:          chairID,
-		OwnerID:     owner.ID,
-		Name:        req.Name,
-		Model:       req.Model,
-		IsActive:    false,
-		AccessToken: accessToken,
-	})
-	if err != nil {
+	chair := &Chair{
+		ID:              chairID,
+		OwnerID:         token.OwnerID,
+		Name:            req.Name,
+		Model:           req.Model,
+		IsActive:        false,
+		AccessToken:     accessToken,
+		RegisterTokenID: &token.ID,
+	}
+	if err := chairRepo.InsertChair(ctx, tx.Tx, chair); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert chair: %w", err))
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit: %w", err))
+		return
+	}
+	chairRepo.InvalidateCacheByOwnerID(chair.OwnerID)
+	chairStateIndex.AddChair(chair)
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "chair_session",
@@ -68,7 +87,7 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
-		OwnerID: owner.ID,
+		OwnerID: chair.OwnerID,
 	})
 }
 
@@ -86,11 +105,33 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	tx, err := db.Beginx()
 	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err))
+		return
+	}
+	defer tx.Rollback()
+
+	// オーナーが配車受付を停止させている間は、椅子から受付を再開できない
+	var ownerDisabledAt sql.NullTime
+	if err := tx.GetContext(ctx, &ownerDisabledAt, "SELECT owner_disabled_at FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get chair: %w", err))
+		return
+	}
+	if req.IsActive && ownerDisabledAt.Valid {
+		writeError(w, http.StatusForbidden, errors.New("chair is disabled by its owner"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update chair: %w", err))
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit transaction: %w", err))
+		return
+	}
+	chairStateIndex.SetActive(chair.ID, req.IsActive)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -133,30 +174,30 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	var transition *RideTransition
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1 FOR UPDATE`, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride: %w", err))
 			return
 		}
 	} else {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		status, err := rideStateMachine.Current(ctx, tx, ride.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get latest ride status: %w", err))
 			return
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update ride status: %w", err))
-					return
-				}
-			}
-
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update ride status: %w", err))
-					return
-				}
+		next := ""
+		if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == RideStatusEnroute {
+			next = RideStatusPickup
+		}
+		if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == RideStatusCarrying {
+			next = RideStatusArrived
+		}
+		if next != "" {
+			transition, err = rideStateMachine.Transition(ctx, tx, ride.ID, next)
+			if err != nil {
+				writeRideTransitionError(w, err)
+				return
 			}
 		}
 	}
@@ -166,6 +207,18 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chairStateIndex.SetLocation(chair.ID, req.Latitude, req.Longitude)
+	if transition != nil {
+		chairStateIndex.SetRideStatus(chair.ID, ride.ID, transition.To)
+		publishRideEvent(&RideEvent{
+			StatusID: transition.StatusID,
+			RideID:   ride.ID,
+			UserID:   ride.UserID,
+			ChairID:  chair.ID,
+			Status:   transition.To,
+		})
+	}
+
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
 		RecordedAt: location.CreatedAt.UnixMilli(),
 	})
@@ -190,71 +243,234 @@ type chairGetNotificationResponseData struct {
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
+	if wantsJSONNotification(r) {
+		chairGetNotificationLongPoll(w, r)
+		return
+	}
+
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
 
-	// SSE用のヘッダー設定
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	// DBを読む前に購読を開始し、その間に発生したステータス変更を取りこぼさないようにする
+	events, unsubscribe := chairNotificationHub.Subscribe(chair.ID)
+	defer unsubscribe()
+
+	// Last-Event-ID があればそれ以降のステータスを全て再送する
+	replayStatuses := []RideStatus{}
+	found := false
+	if id := lastEventID(r); id != "" {
+		var err error
+		replayStatuses, found, err = selectRideStatusesAfter(ctx, id, "r.chair_id = ?", chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
 
-	// SSEの接続がクローズされた場合の処理
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		writeError(w, http.StatusInternalServerError, errors.New("failed to cast response writer"))
+	stream, err := newSSEWriter(w)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	tx, err := db.Beginx()
+	for _, status := range replayStatuses {
+		if err := sendChairRideStatus(ctx, stream, status); err != nil {
+			slog.Error("failed to send notification", "error", err)
+			return
+		}
+	}
+
+	// 未送信のステータスがあれば最初のものから順に再開する
+	sentCount, err := sendChairUnsentRideStatuses(ctx, stream, chair.ID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err))
+		slog.Error("failed to send notification", "error", err)
 		return
 	}
-	defer tx.Rollback()
+	if !found && sentCount == 0 {
+		// 全て送信済みなら現在の状態を送る
+		ride := &Ride{}
+		if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.Error("failed to get ride", "error", err)
+				return
+			}
+		} else {
+			latest := RideStatus{}
+			if err := db.GetContext(ctx, &latest, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil {
+				slog.Error("failed to get latest ride status", "error", err)
+				return
+			}
+			response, err := buildChairNotification(ctx, ride.ID, latest.Status)
+			if err != nil {
+				slog.Error("failed to build notification", "error", err)
+				return
+			}
+			if err := stream.Send(latest.ID, response); err != nil {
+				return
+			}
+		}
+	}
 
-	// 最新のライドを取得
-	ride := &Ride{}
-	yetSentRideStatus := RideStatus{}
-	status := ""
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				RetryAfterMs: 30,
-			})
+	// 以降はイベントを受け取るたびに未送信のステータスを順に送る
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				// 受信が追いつかなかったので切断し、再接続で未送信分から再開させる
+				return
+			}
+			if _, err := sendChairUnsentRideStatuses(ctx, stream, chair.ID); err != nil {
+				slog.Error("failed to send notification", "error", err)
+				return
+			}
+		case <-heartbeat.C:
+			if err := stream.Heartbeat(); err != nil {
+				return
+			}
+		case <-ctx.Done(): // 接続終了時
 			return
 		}
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride: %w", err))
-		return
 	}
+}
 
-	// ライドの状態を取得
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatus(ctx, tx, ride.ID)
+// chairGetNotificationLongPoll はSSEを使えないクライアント向けに、未送信のステータスが発生するか
+// タイムアウトするまで待ってからJSONで返す
+func chairGetNotificationLongPoll(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	events, unsubscribe := chairNotificationHub.Subscribe(chair.ID)
+	defer unsubscribe()
+
+	timeout := time.NewTimer(notificationLongPollTimeout)
+	defer timeout.Stop()
+
+	for {
+		status := &RideStatus{}
+		err := db.GetContext(ctx, status, `
+			SELECT rs.*
+			FROM ride_statuses rs
+			JOIN rides r ON r.id = rs.ride_id
+			WHERE r.chair_id = ? AND rs.chair_sent_at IS NULL
+			ORDER BY rs.created_at
+			LIMIT 1
+		`, chair.ID)
+		if err == nil {
+			response, err := buildChairNotification(ctx, status.RideID, status.Status)
 			if err != nil {
-				writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get latest ride status: %w", err))
+				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
-		} else {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride status: %w", err))
+			if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, status.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		select {
+		case _, ok := <-events:
+			if !ok {
+				writeChairCurrentNotification(w, r, chair.ID)
+				return
+			}
+		case <-timeout.C:
+			writeChairCurrentNotification(w, r, chair.ID)
+			return
+		case <-ctx.Done():
 			return
 		}
-	} else {
-		status = yetSentRideStatus.Status
 	}
+}
 
-	// ユーザー情報を取得
-	user := &User{}
-	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
+// writeChairCurrentNotification は椅子に割り当てられた最新のライドの現在の状態をJSONで返す
+func writeChairCurrentNotification(w http.ResponseWriter, r *http.Request, chairID string) {
+	ctx := r.Context()
+
+	ride := &Ride{}
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+				RetryAfterMs: notificationRetryAfterMs(),
+			})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride: %w", err))
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get latest ride status: %w", err))
+		return
+	}
+
+	response, err := buildChairNotification(ctx, ride.ID, status)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get user: %w", err))
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sendChairUnsentRideStatuses は椅子にまだ送信していないステータスを古い順に送信する。送信した件数を返す
+func sendChairUnsentRideStatuses(ctx context.Context, stream *sseWriter, chairID string) (int, error) {
+	statuses := []RideStatus{}
+	if err := db.SelectContext(ctx, &statuses, `
+		SELECT rs.*
+		FROM ride_statuses rs
+		JOIN rides r ON r.id = rs.ride_id
+		WHERE r.chair_id = ? AND rs.chair_sent_at IS NULL
+		ORDER BY rs.created_at
+	`, chairID); err != nil {
+		return 0, err
+	}
+
+	for i, status := range statuses {
+		if err := sendChairRideStatus(ctx, stream, status); err != nil {
+			return i, err
+		}
+	}
+	return len(statuses), nil
+}
+
+// sendChairRideStatus はステータスを椅子へ送信し、フラッシュ後に chair_sent_at を記録する
+func sendChairRideStatus(ctx context.Context, stream *sseWriter, status RideStatus) error {
+	response, err := buildChairNotification(ctx, status.RideID, status.Status)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(status.ID, response); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, status.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// buildChairNotification は椅子向け通知の内容を組み立てる
+func buildChairNotification(ctx context.Context, rideID, status string) (*chairGetNotificationResponse, error) {
+	ride := &Ride{}
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	if err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID); err != nil {
+		return nil, err
+	}
 
-	// 初回の通知
-	response := &chairGetNotificationResponse{
+	return &chairGetNotificationResponse{
 		Data: &chairGetNotificationResponseData{
 			RideID: ride.ID,
 			User: simpleUser{
@@ -271,49 +487,8 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 			},
 			Status: status,
 		},
-		RetryAfterMs: 30,
-	}
-
-	// 初回通知を送信
-	sendChairSSEMessage(w, response)
-	flusher.Flush() // 最初の通知後にフラッシュ
-
-	// ライド状態の変化を監視
-	// 定期的にライドの状態をチェックして、変更があれば通知する
-	go func() {
-		ticker := time.NewTicker(30 * time.Second) // 定期的にチェック
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				// 状態が変わった場合のみ通知
-				updatedStatus, err := getLatestRideStatus(ctx, tx, ride.ID)
-				if err != nil {
-					writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get latest ride status: %w", err))
-					return
-				}
-
-				if updatedStatus != status {
-					// 新しい状態を通知
-					status = updatedStatus
-
-					// レスポンスに状態を更新して通知
-					response.Data.Status = status
-					sendChairSSEMessage(w, response)
-					flusher.Flush() // 通知後にフラッシュ
-				}
-			case <-r.Context().Done(): // 接続終了時
-				return
-			}
-		}
-	}()
-
-	// 最後にトランザクションのコミット
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit transaction: %w", err))
-		return
-	}
+		RetryAfterMs: notificationRetryAfterMs(),
+	}, nil
 }
 
 type postChairRidesRideIDStatusRequest struct {
@@ -355,48 +530,60 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch req.Status {
-	// Acknowledge the ride
-	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update ride status: %w", err))
+	// ライドを辞退し、マッチング待ちに戻す。辞退した椅子には同じライドを再び割り当てない
+	case "DECLINED":
+		transition, err := rideStateMachine.Transition(ctx, tx, ride.ID, RideStatusMatching)
+		if err != nil {
+			writeRideTransitionError(w, err)
 			return
 		}
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get latest ride status: %w", err))
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL WHERE id = ?", ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update ride: %w", err))
 			return
 		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO ride_declines (ride_id, chair_id) VALUES (?, ?)", ride.ID, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert ride decline: %w", err))
 			return
 		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update ride status: %w", err))
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit transaction: %w", err))
 			return
 		}
+		chairStateIndex.ReleaseRide(chair.ID, ride.ID)
+		publishRideEvent(&RideEvent{
+			StatusID: transition.StatusID,
+			RideID:   ride.ID,
+			UserID:   ride.UserID,
+			Status:   transition.To,
+		})
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	// Acknowledge the ride / After Picking up user
+	case RideStatusEnroute, RideStatusCarrying:
 	default:
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit transaction: %w", err))
+	transition, err := rideStateMachine.Transition(ctx, tx, ride.ID, req.Status)
+	if err != nil {
+		writeRideTransitionError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
-}
-
-// sendChairSSEMessageは、椅子向けSSEメッセージを送信します
-func sendChairSSEMessage(w http.ResponseWriter, response *chairGetNotificationResponse) {
-	// SSEメッセージを送信
-	jsonData, err := json.Marshal(response)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to marshal json: %w", err))
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit transaction: %w", err))
 		return
 	}
+	chairStateIndex.SetRideStatus(chair.ID, ride.ID, transition.To)
+	publishRideEvent(&RideEvent{
+		StatusID: transition.StatusID,
+		RideID:   ride.ID,
+		UserID:   ride.UserID,
+		ChairID:  chair.ID,
+		Status:   transition.To,
+	})
 
-	// SSEフォーマットで送信
-	fmt.Fprintf(w, "data: %s\n\n", jsonData)
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// defaultChairRegisterTokenName はオーナー登録時に発行する登録トークンの名前
+const defaultChairRegisterTokenName = "default"
+
+var (
+	errChairRegisterTokenInvalid  = errors.New("invalid chair_register_token")
+	errChairModelNotAllowed       = errors.New("chair model is not allowed for this chair_register_token")
+	errChairRegisterTokenNotFound = errors.New("chair register token not found")
+	errChairRegisterTokenRevoked  = errors.New("chair register token already revoked")
+)
+
+// chairModelList は登録を許可する椅子モデルの一覧。JSON の配列として保存する
+type chairModelList []string
+
+func (l *chairModelList) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, l)
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	default:
+		return fmt.Errorf("unsupported type for chair model list: %T", src)
+	}
+}
+
+func (l chairModelList) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal([]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// ChairRegisterToken は椅子の登録に使うトークン。オーナーごとに複数発行できる
+type ChairRegisterToken struct {
+	ID      string `db:"id"`
+	OwnerID string `db:"owner_id"`
+	Name    string `db:"name"`
+	Token   string `db:"token"`
+	// AllowedModels が nil ならどのモデルでも登録できる
+	AllowedModels chairModelList `db:"allowed_models"`
+	// MaxUses が nil なら登録できる椅子の数に上限は無い
+	MaxUses   *int       `db:"max_uses"`
+	Uses      int        `db:"uses"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// usable は登録トークンで model の椅子を登録できるかを検証する
+func (t *ChairRegisterToken) usable(model string, now time.Time) error {
+	if t.RevokedAt != nil {
+		return errChairRegisterTokenInvalid
+	}
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return errChairRegisterTokenInvalid
+	}
+	if t.MaxUses != nil && t.Uses >= *t.MaxUses {
+		return errChairRegisterTokenInvalid
+	}
+	if t.AllowedModels != nil && !slices.Contains(t.AllowedModels, model) {
+		return errChairModelNotAllowed
+	}
+	return nil
+}
+
+// insertChairRegisterToken は登録トークンを保存する
+func insertChairRegisterToken(ctx context.Context, tx *sqlx.Tx, t *ChairRegisterToken) error {
+	if _, err := tx.NamedExecContext(ctx, `
+		INSERT INTO chair_register_tokens (id, owner_id, name, token, allowed_models, max_uses, expires_at)
+		VALUES (:id, :owner_id, :name, :token, :allowed_models, :max_uses, :expires_at)
+	`, t); err != nil {
+		return fmt.Errorf("failed to insert chair register token: %w", err)
+	}
+	return nil
+}
+
+// useChairRegisterToken は登録トークンを検証し、利用回数を1つ増やす
+func useChairRegisterToken(ctx context.Context, tx *sqlx.Tx, token, model string) (*ChairRegisterToken, error) {
+	t := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, t, `SELECT * FROM chair_register_tokens WHERE token = ? FOR UPDATE`, token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errChairRegisterTokenInvalid
+		}
+		return nil, fmt.Errorf("failed to get chair register token: %w", err)
+	}
+	if err := t.usable(model, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE chair_register_tokens SET uses = uses + 1 WHERE id = ?`, t.ID); err != nil {
+		return nil, fmt.Errorf("failed to update chair register token: %w", err)
+	}
+	t.Uses++
+	return t, nil
+}
+
+type ownerPostChairRegisterTokenRequest struct {
+	Name          string   `json:"name"`
+	AllowedModels []string `json:"allowed_models"`
+	MaxUses       *int     `json:"max_uses"`
+	// ExpiresAt は有効期限(UnixMilli)
+	ExpiresAt *int64 `json:"expires_at"`
+}
+
+type ownerChairRegisterTokenResponse struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Token         string   `json:"token,omitempty"`
+	TokenSuffix   string   `json:"token_suffix"`
+	AllowedModels []string `json:"allowed_models"`
+	MaxUses       *int     `json:"max_uses"`
+	Uses          int      `json:"uses"`
+	ExpiresAt     *int64   `json:"expires_at"`
+	RevokedAt     *int64   `json:"revoked_at"`
+	CreatedAt     int64    `json:"created_at"`
+}
+
+// newOwnerChairRegisterTokenResponse はレスポンスを作る。トークンそのものは発行時だけ返す
+func newOwnerChairRegisterTokenResponse(t *ChairRegisterToken, withToken bool) *ownerChairRegisterTokenResponse {
+	res := &ownerChairRegisterTokenResponse{
+		ID:            t.ID,
+		Name:          t.Name,
+		TokenSuffix:   t.Token[max(len(t.Token)-4, 0):],
+		AllowedModels: t.AllowedModels,
+		MaxUses:       t.MaxUses,
+		Uses:          t.Uses,
+		CreatedAt:     t.CreatedAt.UnixMilli(),
+	}
+	if withToken {
+		res.Token = t.Token
+	}
+	if t.ExpiresAt != nil {
+		expiresAt := t.ExpiresAt.UnixMilli()
+		res.ExpiresAt = &expiresAt
+	}
+	if t.RevokedAt != nil {
+		revokedAt := t.RevokedAt.UnixMilli()
+		res.RevokedAt = &revokedAt
+	}
+	return res
+}
+
+type ownerGetChairRegisterTokensResponse struct {
+	Tokens []*ownerChairRegisterTokenResponse `json:"tokens"`
+}
+
+func ownerGetChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	tokens := []ChairRegisterToken{}
+	if err := db.SelectContext(ctx, &tokens, `SELECT * FROM chair_register_tokens WHERE owner_id = ? ORDER BY created_at, id`, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &ownerGetChairRegisterTokensResponse{
+		Tokens: make([]*ownerChairRegisterTokenResponse, 0, len(tokens)),
+	}
+	for i := range tokens {
+		res.Tokens = append(res.Tokens, newOwnerChairRegisterTokenResponse(&tokens[i], false))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostChairRegisterTokenRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_uses must be positive"))
+		return
+	}
+
+	t := &ChairRegisterToken{
+		ID:      ulid.Make().String(),
+		OwnerID: owner.ID,
+		Name:    req.Name,
+		Token:   secureRandomStr(32),
+		MaxUses: req.MaxUses,
+	}
+	if req.AllowedModels != nil {
+		t.AllowedModels = chairModelList(req.AllowedModels)
+	}
+	if req.ExpiresAt != nil {
+		expiresAt := time.UnixMilli(*req.ExpiresAt)
+		if !expiresAt.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
+		}
+		t.ExpiresAt = &expiresAt
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if t.AllowedModels != nil {
+		for _, model := range t.AllowedModels {
+			var exists bool
+			if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM chair_models WHERE name = ?)`, model); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !exists {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("unknown chair model: %s", model))
+				return
+			}
+		}
+	}
+
+	if err := insertChairRegisterToken(ctx, tx, t); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.GetContext(ctx, t, `SELECT * FROM chair_register_tokens WHERE id = ?`, t.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerChairRegisterTokenResponse(t, true))
+}
+
+// ownerDeleteChairRegisterToken は登録トークンを無効にする。登録済みの椅子には影響しない
+func ownerDeleteChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tokenID := r.PathValue("token_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	t := &ChairRegisterToken{}
+	if err := db.GetContext(ctx, t, `SELECT * FROM chair_register_tokens WHERE id = ? AND owner_id = ?`, tokenID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errChairRegisterTokenNotFound)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, `UPDATE chair_register_tokens SET revoked_at = NOW(6) WHERE id = ? AND revoked_at IS NULL`, t.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusConflict, errChairRegisterTokenRevoked)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,7 +3,17 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
+)
+
+var (
+	errChairNotFound         = errors.New("chair not found")
+	errChairRetired          = errors.New("chair is retired")
+	errChairHasOngoingRide   = errors.New("chair has an ongoing ride")
+	errTransferOwnerNotFound = errors.New("transfer destination owner not found")
 )
 
 type ChairRepository struct {
@@ -55,7 +65,7 @@ func (r *ChairRepository) InvalidateCacheByOwnerID(ownerID string) {
 
 func (r *ChairRepository) selectChairsByOwnerID(ctx context.Context, ownerID string, dest *[]Chair) error {
 	rows, err := r.db.QueryContext(ctx, `
-		SELECT id, owner_id, name, model, is_active, access_token, created_at, updated_at
+		SELECT id, owner_id, name, model, is_active, access_token, created_at, updated_at, retired_at, owner_disabled_at
 		FROM chairs
 		WHERE owner_id = ?
 	`, ownerID)
@@ -67,7 +77,7 @@ func (r *ChairRepository) selectChairsByOwnerID(ctx context.Context, ownerID str
 	var results []Chair
 	for rows.Next() {
 		var c Chair
-		if err := rows.Scan(&c.ID, &c.OwnerID, &c.Name, &c.Model, &c.IsActive, &c.AccessToken, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		if err := rows.Scan(&c.ID, &c.OwnerID, &c.Name, &c.Model, &c.IsActive, &c.AccessToken, &c.CreatedAt, &c.UpdatedAt, &c.RetiredAt, &c.OwnerDisabledAt); err != nil {
 			return err
 		}
 		results = append(results, c)
@@ -80,11 +90,151 @@ func (r *ChairRepository) selectChairsByOwnerID(ctx context.Context, ownerID str
 	return nil
 }
 
-func (r *ChairRepository) InsertChair(ctx context.Context, c *Chair) error {
-	r.InvalidateCacheByOwnerID(c.OwnerID)
-	_, err := r.db.ExecContext(ctx, `
-		INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, c.ID, c.OwnerID, c.Name, c.Model, c.IsActive, c.AccessToken, c.CreatedAt, c.UpdatedAt)
+// InsertChair は tx の中で椅子を登録する。コミットした後に InvalidateCacheByOwnerID を呼ぶこと
+func (r *ChairRepository) InsertChair(ctx context.Context, tx *sql.Tx, c *Chair) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, chair_register_token_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, c.ID, c.OwnerID, c.Name, c.Model, c.IsActive, c.AccessToken, c.RegisterTokenID, c.CreatedAt, c.UpdatedAt)
 	return err
 }
+
+// lockOwnedChair はオーナーの椅子の行をロックして取得する。引退済みの椅子は errChairRetired を返す
+func (r *ChairRepository) lockOwnedChair(ctx context.Context, tx *sql.Tx, ownerID, chairID string) (*Chair, error) {
+	c := &Chair{}
+	if err := tx.QueryRowContext(ctx, `
+		SELECT id, owner_id, name, model, is_active, retired_at, owner_disabled_at FROM chairs WHERE id = ? AND owner_id = ? FOR UPDATE
+	`, chairID, ownerID).Scan(&c.ID, &c.OwnerID, &c.Name, &c.Model, &c.IsActive, &c.RetiredAt, &c.OwnerDisabledAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errChairNotFound
+		}
+		return nil, err
+	}
+	if c.RetiredAt != nil {
+		return nil, errChairRetired
+	}
+	return c, nil
+}
+
+// updateOwnedChair はオーナーの椅子をロックして fn で更新し、オーナーのキャッシュを無効化する
+func (r *ChairRepository) updateOwnedChair(ctx context.Context, ownerID, chairID string, fn func(tx *sql.Tx, c *Chair) error) (*Chair, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	c, err := r.lockOwnedChair(ctx, tx, ownerID, chairID)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(tx, c); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.InvalidateCacheByOwnerID(ownerID)
+	return c, nil
+}
+
+// RenameChair は椅子の名前を変更する
+func (r *ChairRepository) RenameChair(ctx context.Context, ownerID, chairID, name string) (*Chair, error) {
+	return r.updateOwnedChair(ctx, ownerID, chairID, func(tx *sql.Tx, c *Chair) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET name = ? WHERE id = ?`, name, c.ID); err != nil {
+			return fmt.Errorf("failed to rename chair: %w", err)
+		}
+		c.Name = name
+		return nil
+	})
+}
+
+// DeactivateChair は椅子を配車受付停止にする。EnableChair で解除するまで椅子は自分で受付を再開できない
+func (r *ChairRepository) DeactivateChair(ctx context.Context, ownerID, chairID string) (*Chair, error) {
+	return r.updateOwnedChair(ctx, ownerID, chairID, func(tx *sql.Tx, c *Chair) error {
+		now := time.Now()
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET is_active = FALSE, owner_disabled_at = ? WHERE id = ?`, now, c.ID); err != nil {
+			return fmt.Errorf("failed to deactivate chair: %w", err)
+		}
+		c.IsActive = false
+		c.OwnerDisabledAt = &now
+		return nil
+	})
+}
+
+// EnableChair はオーナーによる配車受付の停止を解除する。受付の再開は椅子が自分で行う
+func (r *ChairRepository) EnableChair(ctx context.Context, ownerID, chairID string) (*Chair, error) {
+	return r.updateOwnedChair(ctx, ownerID, chairID, func(tx *sql.Tx, c *Chair) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET owner_disabled_at = NULL WHERE id = ?`, c.ID); err != nil {
+			return fmt.Errorf("failed to enable chair: %w", err)
+		}
+		c.OwnerDisabledAt = nil
+		return nil
+	})
+}
+
+// checkNoOngoingRide は椅子に未完了のライドが割り当てられていれば errChairHasOngoingRide を返す
+// 椅子の行をロックした状態で呼び出すこと
+func checkNoOngoingRide(ctx context.Context, tx *sql.Tx, chairID string) error {
+	var ongoing bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM rides
+			WHERE chair_id = ?
+			AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status IN ('COMPLETED', 'CANCELED'))
+		)
+	`, chairID).Scan(&ongoing); err != nil {
+		return fmt.Errorf("failed to check ongoing rides: %w", err)
+	}
+	if ongoing {
+		return errChairHasOngoingRide
+	}
+	return nil
+}
+
+// RetireChair は椅子を引退させる。配車受付を停止してアクセストークンを無効にし、以降は元に戻せない
+// 未完了のライドがある場合は errChairHasOngoingRide を返す
+func (r *ChairRepository) RetireChair(ctx context.Context, ownerID, chairID string) (*Chair, error) {
+	return r.updateOwnedChair(ctx, ownerID, chairID, func(tx *sql.Tx, c *Chair) error {
+		if err := checkNoOngoingRide(ctx, tx, c.ID); err != nil {
+			return err
+		}
+
+		// 空のアクセストークンは認証で受け付けないので、これで椅子のセッションは使えなくなる
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET is_active = FALSE, access_token = '', retired_at = NOW(6) WHERE id = ?`, c.ID); err != nil {
+			return fmt.Errorf("failed to retire chair: %w", err)
+		}
+		c.IsActive = false
+		return nil
+	})
+}
+
+// TransferChair は椅子を別のオーナーに移す。移す前と後の両方のオーナーのキャッシュを無効化する
+// ライドの売上は完了時点の椅子のオーナー(rides.owner_id)に計上され、譲渡しても過去の売上は元のオーナーに残る
+// 未完了のライドの計上先が曖昧にならないよう、未完了のライドがある場合は errChairHasOngoingRide を返す
+func (r *ChairRepository) TransferChair(ctx context.Context, ownerID, chairID, newOwnerID string) (*Chair, error) {
+	c, err := r.updateOwnedChair(ctx, ownerID, chairID, func(tx *sql.Tx, c *Chair) error {
+		if err := checkNoOngoingRide(ctx, tx, c.ID); err != nil {
+			return err
+		}
+
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM owners WHERE id = ?)`, newOwnerID).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check owner: %w", err)
+		}
+		if !exists {
+			return errTransferOwnerNotFound
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE chairs SET owner_id = ? WHERE id = ?`, newOwnerID, c.ID); err != nil {
+			return fmt.Errorf("failed to transfer chair: %w", err)
+		}
+		c.OwnerID = newOwnerID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.InvalidateCacheByOwnerID(newOwnerID)
+	return c, nil
+}
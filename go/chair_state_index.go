@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// chairState は椅子ごとの最新状態
+type chairState struct {
+	ID          string
+	OwnerID     string
+	Name        string
+	Model       string
+	Speed       int
+	Tier        string
+	IsActive    bool
+	HasLocation bool
+	Latitude    int
+	Longitude   int
+	// RideID は最後に割り当てられたライド。RideStatus はそのライドの最新ステータス
+	RideID     string
+	RideStatus string
+	IdleSince  time.Time
+}
+
+// isFree は新しいライドを割り当てられる状態かどうかを返す
+func (s *chairState) isFree() bool {
+	return s.IsActive && s.HasLocation && (s.RideID == "" || rideStateMachine.IsTerminal(s.RideStatus))
+}
+
+// ChairStateIndex はプロセス内で椅子の状態を保持し、マッチングや近くの椅子検索でDBを参照せずに済むようにする
+// 起動時と初期化時に Rebuild でDBから再構築し、以降は各ハンドラから更新する
+// 割り当て可能な椅子は空間グリッドにも登録し、座標による範囲検索に使う
+type ChairStateIndex struct {
+	db     *sqlx.DB
+	mutex  sync.RWMutex
+	chairs map[string]*chairState
+	speeds map[string]int
+	tiers  map[string]string
+	free   *chairGrid
+	// rebuildMutex は Rebuild を直列化する
+	rebuildMutex sync.Mutex
+	// replay は Rebuild 中に行われた更新。DBから読んだ状態に適用し直してから差し替える
+	rebuilding bool
+	replay     []func()
+}
+
+func NewChairStateIndex(db *sqlx.DB) (*ChairStateIndex, error) {
+	return &ChairStateIndex{
+		db:     db,
+		chairs: map[string]*chairState{},
+		speeds: map[string]int{},
+		tiers:  map[string]string{},
+		free:   newChairGrid(chairGridCellSize),
+	}, nil
+}
+
+// update は mutex を取得して fn で状態を更新する
+// Rebuild 中の更新は、DBから読んだ時点に反映されていない可能性があるので記録しておく
+func (i *ChairStateIndex) update(fn func()) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	fn()
+	if i.rebuilding {
+		i.replay = append(i.replay, fn)
+	}
+}
+
+// reindex は椅子の状態に合わせてグリッドへの登録を更新する
+// mutex を取得した状態で呼び出すこと
+func (i *ChairStateIndex) reindex(s *chairState) {
+	if s.isFree() {
+		i.free.put(s.ID, s.Latitude, s.Longitude)
+	} else {
+		i.free.remove(s.ID)
+	}
+}
+
+// Rebuild はDBの内容から状態を作り直す
+// DBを読んでいる間の更新は読み終えた状態に適用し直すので、差し替えによって失われない
+func (i *ChairStateIndex) Rebuild(ctx context.Context) error {
+	i.rebuildMutex.Lock()
+	defer i.rebuildMutex.Unlock()
+
+	i.mutex.Lock()
+	i.rebuilding = true
+	i.replay = nil
+	i.mutex.Unlock()
+	defer func() {
+		i.mutex.Lock()
+		i.rebuilding = false
+		i.replay = nil
+		i.mutex.Unlock()
+	}()
+
+	models := []ChairModel{}
+	if err := i.db.SelectContext(ctx, &models, "SELECT * FROM chair_models"); err != nil {
+		return fmt.Errorf("failed to select chair models: %w", err)
+	}
+	speeds := make(map[string]int, len(models))
+	tiers := make(map[string]string, len(models))
+	for _, m := range models {
+		speeds[m.Name] = m.Speed
+		tiers[m.Name] = m.Tier
+	}
+
+	chairs := []Chair{}
+	if err := i.db.SelectContext(ctx, &chairs, "SELECT * FROM chairs"); err != nil {
+		return fmt.Errorf("failed to select chairs: %w", err)
+	}
+	states := make(map[string]*chairState, len(chairs))
+	for _, c := range chairs {
+		// 引退した椅子は二度と割り当てないのでインデックスに載せない
+		if c.RetiredAt != nil {
+			continue
+		}
+		states[c.ID] = &chairState{
+			ID:        c.ID,
+			OwnerID:   c.OwnerID,
+			Name:      c.Name,
+			Model:     c.Model,
+			Speed:     speeds[c.Model],
+			Tier:      tiers[c.Model],
+			IsActive:  c.IsActive,
+			IdleSince: c.CreatedAt,
+		}
+	}
+
+	locations := []ChairLocation{}
+	if err := i.db.SelectContext(ctx, &locations, `
+		SELECT cl.*
+		FROM chair_locations cl
+		JOIN (
+			SELECT chair_id, MAX(created_at) AS created_at
+			FROM chair_locations
+			GROUP BY chair_id
+		) latest ON latest.chair_id = cl.chair_id AND latest.created_at = cl.created_at
+	`); err != nil {
+		return fmt.Errorf("failed to select chair locations: %w", err)
+	}
+	for _, loc := range locations {
+		if s, ok := states[loc.ChairID]; ok {
+			s.HasLocation = true
+			s.Latitude = loc.Latitude
+			s.Longitude = loc.Longitude
+		}
+	}
+
+	type finishedRide struct {
+		ChairID    string    `db:"chair_id"`
+		RideID     string    `db:"ride_id"`
+		Status     string    `db:"status"`
+		FinishedAt time.Time `db:"finished_at"`
+	}
+	finished := []finishedRide{}
+	if err := i.db.SelectContext(ctx, &finished, `
+		SELECT r.chair_id, r.id AS ride_id, rs.status, rs.created_at AS finished_at
+		FROM rides r
+		JOIN ride_statuses rs ON rs.ride_id = r.id
+		WHERE r.chair_id IS NOT NULL AND rs.status IN ('COMPLETED', 'CANCELED')
+		ORDER BY rs.created_at
+	`); err != nil {
+		return fmt.Errorf("failed to select finished rides: %w", err)
+	}
+	for _, f := range finished {
+		if s, ok := states[f.ChairID]; ok {
+			s.RideID = f.RideID
+			s.RideStatus = f.Status
+			s.IdleSince = f.FinishedAt
+		}
+	}
+
+	// 未完了のライドがあればそちらを優先する
+	type ongoingRide struct {
+		ChairID string         `db:"chair_id"`
+		RideID  string         `db:"ride_id"`
+		Status  sql.NullString `db:"status"`
+	}
+	ongoing := []ongoingRide{}
+	if err := i.db.SelectContext(ctx, &ongoing, `
+		SELECT r.chair_id, r.id AS ride_id,
+		       (SELECT rs.status FROM ride_statuses rs WHERE rs.ride_id = r.id ORDER BY rs.created_at DESC LIMIT 1) AS status
+		FROM rides r
+		WHERE r.chair_id IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status IN ('COMPLETED', 'CANCELED'))
+	`); err != nil {
+		return fmt.Errorf("failed to select ongoing rides: %w", err)
+	}
+	for _, o := range ongoing {
+		if s, ok := states[o.ChairID]; ok {
+			s.RideID = o.RideID
+			s.RideStatus = o.Status.String
+		}
+	}
+
+	free := newChairGrid(chairGridCellSize)
+	for _, s := range states {
+		if s.isFree() {
+			free.put(s.ID, s.Latitude, s.Longitude)
+		}
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.chairs = states
+	i.speeds = speeds
+	i.tiers = tiers
+	i.free = free
+	for _, fn := range i.replay {
+		fn()
+	}
+
+	return nil
+}
+
+// AddChair は新しく登録された椅子を追加する
+func (i *ChairStateIndex) AddChair(c *Chair) {
+	i.update(func() {
+		i.chairs[c.ID] = &chairState{
+			ID:        c.ID,
+			OwnerID:   c.OwnerID,
+			Name:      c.Name,
+			Model:     c.Model,
+			Speed:     i.speeds[c.Model],
+			Tier:      i.tiers[c.Model],
+			IsActive:  c.IsActive,
+			IdleSince: time.Now(),
+		}
+	})
+}
+
+// SetActive は椅子の稼働状態を更新する
+func (i *ChairStateIndex) SetActive(chairID string, isActive bool) {
+	i.update(func() {
+		if s, ok := i.chairs[chairID]; ok {
+			s.IsActive = isActive
+			i.reindex(s)
+		}
+	})
+}
+
+// SetName は椅子の名前を更新する
+func (i *ChairStateIndex) SetName(chairID, name string) {
+	i.update(func() {
+		if s, ok := i.chairs[chairID]; ok {
+			s.Name = name
+		}
+	})
+}
+
+// SetOwner は椅子のオーナーを更新する
+func (i *ChairStateIndex) SetOwner(chairID, ownerID string) {
+	i.update(func() {
+		if s, ok := i.chairs[chairID]; ok {
+			s.OwnerID = ownerID
+		}
+	})
+}
+
+// RemoveChair は引退した椅子をインデックスから取り除く
+func (i *ChairStateIndex) RemoveChair(chairID string) {
+	i.update(func() {
+		i.free.remove(chairID)
+		delete(i.chairs, chairID)
+	})
+}
+
+// SetLocation は椅子の最新位置を更新する
+func (i *ChairStateIndex) SetLocation(chairID string, latitude, longitude int) {
+	i.update(func() {
+		if s, ok := i.chairs[chairID]; ok {
+			s.HasLocation = true
+			s.Latitude = latitude
+			s.Longitude = longitude
+			i.reindex(s)
+		}
+	})
+}
+
+// SetRideStatus は椅子に割り当てられたライドとその最新ステータスを更新する
+func (i *ChairStateIndex) SetRideStatus(chairID, rideID, status string) {
+	i.update(func() {
+		if s, ok := i.chairs[chairID]; ok {
+			s.RideID = rideID
+			s.RideStatus = status
+			if rideStateMachine.IsTerminal(status) {
+				s.IdleSince = time.Now()
+			}
+			i.reindex(s)
+		}
+	})
+}
+
+// ReleaseRide は椅子がライドを辞退した際に割り当てを解除する
+func (i *ChairStateIndex) ReleaseRide(chairID, rideID string) {
+	i.update(func() {
+		if s, ok := i.chairs[chairID]; ok && s.RideID == rideID {
+			s.RideID = ""
+			s.RideStatus = ""
+			s.IdleSince = time.Now()
+			i.reindex(s)
+		}
+	})
+}
+
+// FreeChairs は新しいライドを割り当てられる椅子の一覧を返す
+func (i *ChairStateIndex) FreeChairs() []chairState {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	chairs := make([]chairState, 0, len(i.free.located))
+	for id := range i.free.located {
+		chairs = append(chairs, *i.chairs[id])
+	}
+	return chairs
+}
+
+// NearbyFreeChairs は (latitude, longitude) からマンハッタン距離 distance 以内にいる割り当て可能な椅子を返す
+func (i *ChairStateIndex) NearbyFreeChairs(latitude, longitude, distance int) []chairState {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	chairs := []chairState{}
+	i.free.within(latitude, longitude, distance, func(id string) {
+		s := i.chairs[id]
+		if calculateDistance(latitude, longitude, s.Latitude, s.Longitude) <= distance {
+			chairs = append(chairs, *s)
+		}
+	})
+	return chairs
+}
+
+// CountFreeChairsInArea は矩形の範囲(境界を含む)にいる割り当て可能な椅子の数を返す
+func (i *ChairStateIndex) CountFreeChairsInArea(minLatitude, minLongitude, maxLatitude, maxLongitude int) int {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	centerLatitude := (minLatitude + maxLatitude) / 2
+	centerLongitude := (minLongitude + maxLongitude) / 2
+	distance := max(maxLatitude-centerLatitude, maxLongitude-centerLongitude, centerLatitude-minLatitude, centerLongitude-minLongitude)
+
+	count := 0
+	i.free.within(centerLatitude, centerLongitude, distance, func(id string) {
+		s := i.chairs[id]
+		if s.Latitude >= minLatitude && s.Latitude <= maxLatitude && s.Longitude >= minLongitude && s.Longitude <= maxLongitude {
+			count++
+		}
+	})
+	return count
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// errCircuitOpen はサーキットブレーカーが開いていてリクエストを送らなかったことを表す
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerState はサーキットブレーカーの状態
+type CircuitBreakerState struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at"`
+}
+
+// circuitBreaker は連続して failureThreshold 回失敗すると開き、openTimeout の間リクエストを止める
+// openTimeout が過ぎると半開きになり、1つだけ試行させて成功すれば閉じ、失敗すれば再び開く
+type circuitBreaker struct {
+	mutex            sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(failureThreshold int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		state:            CircuitClosed,
+	}
+}
+
+// Allow はリクエストを送ってよいかを判定する。送ってよい場合は結果を Record で報告すること
+func (b *circuitBreaker) Allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return errCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if b.probing {
+			return errCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Record はリクエストの結果を報告する
+func (b *circuitBreaker) Record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if success {
+		b.state = CircuitClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.failureThreshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// State は現在の状態を返す
+func (b *circuitBreaker) State() CircuitBreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := CircuitBreakerState{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+	}
+	if b.state != CircuitClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
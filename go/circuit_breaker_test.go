@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// elapseOpenTimeout は開いてから openTimeout が過ぎた状態にする
+func elapseOpenTimeout(b *circuitBreaker) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.openedAt = time.Now().Add(-b.openTimeout - time.Millisecond)
+}
+
+func assertCircuitState(t *testing.T, b *circuitBreaker, want string) {
+	t.Helper()
+	if got := b.State().State; got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+// openCircuit は failureThreshold 回失敗させてブレーカーを開く
+func openCircuit(t *testing.T, b *circuitBreaker) {
+	t.Helper()
+	for range b.failureThreshold {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow() = %v, want nil", err)
+		}
+		b.Record(false)
+	}
+	assertCircuitState(t, b, CircuitOpen)
+}
+
+func TestCircuitBreakerOpensAtThreshold(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute)
+
+	for i := range 2 {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow() = %v, want nil", err)
+		}
+		b.Record(false)
+		assertCircuitState(t, b, CircuitClosed)
+		if got := b.State().ConsecutiveFailures; got != i+1 {
+			t.Fatalf("consecutive failures = %d, want %d", got, i+1)
+		}
+	}
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() = %v, want nil", err)
+	}
+	b.Record(false)
+	assertCircuitState(t, b, CircuitOpen)
+	if b.State().OpenedAt == nil {
+		t.Fatal("opened_at is nil")
+	}
+	if err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() = %v, want errCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute)
+
+	for range 2 {
+		b.Allow()
+		b.Record(false)
+	}
+	b.Allow()
+	b.Record(true)
+	if got := b.State().ConsecutiveFailures; got != 0 {
+		t.Fatalf("consecutive failures = %d, want 0", got)
+	}
+
+	// 連続していない失敗では開かない
+	for range 2 {
+		b.Allow()
+		b.Record(false)
+	}
+	assertCircuitState(t, b, CircuitClosed)
+}
+
+func TestCircuitBreakerHalfOpenAfterTimeout(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+	openCircuit(t, b)
+
+	if err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() before timeout = %v, want errCircuitOpen", err)
+	}
+
+	elapseOpenTimeout(b)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after timeout = %v, want nil", err)
+	}
+	assertCircuitState(t, b, CircuitHalfOpen)
+
+	// 半開きの間は1つしか試行させない
+	if err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("second Allow() while half-open = %v, want errCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpenTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		success bool
+		want    string
+	}{
+		{"probe succeeds", true, CircuitClosed},
+		{"probe fails", false, CircuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(2, time.Minute)
+			openCircuit(t, b)
+			elapseOpenTimeout(b)
+			if err := b.Allow(); err != nil {
+				t.Fatalf("Allow() = %v, want nil", err)
+			}
+
+			b.Record(tt.success)
+			assertCircuitState(t, b, tt.want)
+
+			if tt.success {
+				if err := b.Allow(); err != nil {
+					t.Fatalf("Allow() after closing = %v, want nil", err)
+				}
+				return
+			}
+			// 再び開いたら openTimeout の間は止める
+			if err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+				t.Fatalf("Allow() after reopening = %v, want errCircuitOpen", err)
+			}
+		})
+	}
+}
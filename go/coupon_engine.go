@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// CouponTypeFlat はクーポンごとの割引額(coupons.discount)を差し引く
+	CouponTypeFlat = "flat"
+	// CouponTypePercent は運賃の一定割合を差し引く。max_discount があればそれを上限とする
+	CouponTypePercent = "percent"
+)
+
+const (
+	couponDefinitionNew2024  = "CP_NEW2024"
+	couponDefinitionInvited  = "INV"
+	couponDefinitionInviter  = "RWD"
+	couponDefinitionRefund   = "RF"
+	couponDefinitionFallback = "flat"
+)
+
+// CouponDefinition はクーポンの種類ごとの適用ルール
+type CouponDefinition struct {
+	Name    string `db:"name"`
+	Type    string `db:"type"`
+	Percent *int   `db:"percent"`
+	// MaxDiscount は割引額の上限
+	MaxDiscount *int `db:"max_discount"`
+	// MinFare は適用に必要な割引前の運賃
+	MinFare int `db:"min_fare"`
+	// ExpiresAt を過ぎると適用できない
+	ExpiresAt *time.Time `db:"expires_at"`
+	// FirstRideOnly なら初めてのライドにだけ適用できる
+	FirstRideOnly bool `db:"first_ride_only"`
+	// MaxUses はこの種類のクーポンを利用者ごとに使える回数
+	MaxUses *int `db:"max_uses"`
+	// ValidDays は付与してからクーポンを使える日数。nil なら無期限
+	ValidDays   *int   `db:"valid_days"`
+	Description string `db:"description"`
+}
+
+// couponContext はクーポンを適用するライドの状況
+type couponContext struct {
+	// Fare は割引前の運賃
+	Fare int
+	// MeteredFare は運賃のうち距離に応じた部分。割引はこの範囲で行う
+	MeteredFare int
+	// FirstRide は利用者にとって初めてのライドかどうか
+	FirstRide bool
+	// Uses はクーポンの種類ごとの利用者の利用回数
+	Uses map[string]int
+	Now  time.Time
+}
+
+// discount はクーポンの割引額を返す。適用できない場合は false を返す
+func (d *CouponDefinition) discount(coupon *Coupon, c *couponContext) (int, bool) {
+	if d.ExpiresAt != nil && !c.Now.Before(*d.ExpiresAt) {
+		return 0, false
+	}
+	if d.FirstRideOnly && !c.FirstRide {
+		return 0, false
+	}
+	if d.MaxUses != nil && c.Uses[d.Name] >= *d.MaxUses {
+		return 0, false
+	}
+	if c.Fare < d.MinFare {
+		return 0, false
+	}
+
+	var discount int
+	switch d.Type {
+	case CouponTypePercent:
+		if d.Percent == nil {
+			return 0, false
+		}
+		discount = c.MeteredFare * *d.Percent / 100
+	default:
+		discount = coupon.Discount
+	}
+	if d.MaxDiscount != nil {
+		discount = min(discount, *d.MaxDiscount)
+	}
+	return min(discount, c.MeteredFare), true
+}
+
+// selectCouponDefinitions はクーポンの種類ごとのルールを返す
+func selectCouponDefinitions(ctx context.Context, q sqlx.QueryerContext) (map[string]*CouponDefinition, error) {
+	defs := []*CouponDefinition{}
+	if err := sqlx.SelectContext(ctx, q, &defs, `SELECT * FROM coupon_definitions`); err != nil {
+		return nil, fmt.Errorf("failed to select coupon definitions: %w", err)
+	}
+	m := make(map[string]*CouponDefinition, len(defs))
+	for _, d := range defs {
+		m[d.Name] = d
+	}
+	return m, nil
+}
+
+func couponDefinitionOf(defs map[string]*CouponDefinition, coupon *Coupon) *CouponDefinition {
+	if d, ok := defs[coupon.Definition]; ok {
+		return d
+	}
+	if d, ok := defs[couponDefinitionFallback]; ok {
+		return d
+	}
+	return &CouponDefinition{Name: couponDefinitionFallback, Type: CouponTypeFlat}
+}
+
+// buildCouponContext はユーザーの利用状況を集める。rideID はクーポンを適用するライド(見積もりの場合は空)
+func buildCouponContext(ctx context.Context, tx *sqlx.Tx, userID, rideID string, fare, meteredFare int) (*couponContext, error) {
+	var previousRides int
+	if err := tx.GetContext(ctx, &previousRides, `
+		SELECT COUNT(*) FROM rides
+		WHERE user_id = ? AND id != ?
+		AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status = 'CANCELED')
+	`, userID, rideID); err != nil {
+		return nil, fmt.Errorf("failed to count rides: %w", err)
+	}
+
+	type definitionUses struct {
+		Definition string `db:"definition"`
+		Uses       int    `db:"uses"`
+	}
+	uses := []definitionUses{}
+	if err := tx.SelectContext(ctx, &uses, `
+		SELECT definition, COUNT(*) AS uses FROM coupons
+		WHERE user_id = ? AND used_by IS NOT NULL AND used_by != ?
+		GROUP BY definition
+	`, userID, rideID); err != nil {
+		return nil, fmt.Errorf("failed to count coupon uses: %w", err)
+	}
+
+	c := &couponContext{
+		Fare:        fare,
+		MeteredFare: meteredFare,
+		FirstRide:   previousRides == 0,
+		Uses:        make(map[string]int, len(uses)),
+		Now:         time.Now(),
+	}
+	for _, u := range uses {
+		c.Uses[u.Definition] = u.Uses
+	}
+	return c, nil
+}
+
+// issueCoupon はクーポンの種類に従って有効期限を決め、ユーザーにクーポンを付与する
+func issueCoupon(ctx context.Context, tx *sqlx.Tx, userID, code string, discount int, definition string) error {
+	def := &CouponDefinition{}
+	if err := tx.GetContext(ctx, def, `SELECT * FROM coupon_definitions WHERE name = ?`, definition); err != nil {
+		return fmt.Errorf("failed to select coupon definition: %w", err)
+	}
+
+	// キャンペーンの期限と付与からの日数のうち早い方を有効期限とする
+	expiresAt := def.ExpiresAt
+	if def.ValidDays != nil {
+		t := time.Now().AddDate(0, 0, *def.ValidDays)
+		if expiresAt == nil || t.Before(*expiresAt) {
+			expiresAt = &t
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO coupons (user_id, code, discount, definition, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, code, discount, definition, expiresAt,
+	); err != nil {
+		return fmt.Errorf("failed to insert coupon: %w", err)
+	}
+	return nil
+}
+
+// selectBestCoupon は未使用のクーポンのうち最も割引額が大きいものを選ぶ
+// 割引額が同じ場合は先に付与されたものを選ぶ。適用できるクーポンが無ければ nil を返す
+// lock が true の場合は選んだクーポンを使用済みにするため、候補の行をロックする
+func selectBestCoupon(ctx context.Context, tx *sqlx.Tx, userID, rideID string, fare, meteredFare int, lock bool) (*Coupon, int, error) {
+	// 期限切れのクーポンは CouponSweeper が処理する前でも候補にしない
+	query := `SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL AND expired_at IS NULL AND (expires_at IS NULL OR expires_at > NOW(6)) ORDER BY created_at, code`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, query, userID); err != nil {
+		return nil, 0, fmt.Errorf("failed to select coupons: %w", err)
+	}
+	if len(coupons) == 0 {
+		return nil, 0, nil
+	}
+
+	defs, err := selectCouponDefinitions(ctx, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	c, err := buildCouponContext(ctx, tx, userID, rideID, fare, meteredFare)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var best *Coupon
+	bestDiscount := 0
+	for i := range coupons {
+		discount, ok := couponDefinitionOf(defs, &coupons[i]).discount(&coupons[i], c)
+		if !ok {
+			continue
+		}
+		if best == nil || discount > bestDiscount {
+			best = &coupons[i]
+			bestDiscount = discount
+		}
+	}
+	return best, bestDiscount, nil
+}
+
+// appliedCoupon はライドに適用済みのクーポンとその割引額を返す。クーポンが無ければ nil を返す
+func appliedCoupon(ctx context.Context, q sqlx.QueryerContext, ride *Ride, fare, meteredFare int) (*Coupon, int, error) {
+	coupon := &Coupon{}
+	if err := sqlx.GetContext(ctx, q, coupon, `SELECT * FROM coupons WHERE used_by = ?`, ride.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	defs, err := selectCouponDefinitions(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	def := couponDefinitionOf(defs, coupon)
+
+	// 適用の可否はライド作成時に判定済みなので、割引額の計算だけ行う
+	discount, _ := (&CouponDefinition{
+		Name:        def.Name,
+		Type:        def.Type,
+		Percent:     def.Percent,
+		MaxDiscount: def.MaxDiscount,
+	}).discount(coupon, &couponContext{Fare: fare, MeteredFare: meteredFare, Now: time.Now()})
+	return coupon, discount, nil
+}
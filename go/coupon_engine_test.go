@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCouponDefinitionDiscount(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	now := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		def      CouponDefinition
+		discount int
+		ctx      couponContext
+		want     int
+		wantOK   bool
+	}{
+		{
+			name:     "flat",
+			def:      CouponDefinition{Type: CouponTypeFlat},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     300,
+			wantOK:   true,
+		},
+		{
+			name:     "flat is limited to the metered fare",
+			def:      CouponDefinition{Type: CouponTypeFlat},
+			discount: 3000,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     1000,
+			wantOK:   true,
+		},
+		{
+			name:     "percent of the metered fare",
+			def:      CouponDefinition{Type: CouponTypePercent, Percent: intPtr(20)},
+			discount: 999,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     200,
+			wantOK:   true,
+		},
+		{
+			name:   "percent without percent is not applicable",
+			def:    CouponDefinition{Type: CouponTypePercent},
+			ctx:    couponContext{Fare: 1500, MeteredFare: 1000},
+			want:   0,
+			wantOK: false,
+		},
+		{
+			name:     "unknown type falls back to flat",
+			def:      CouponDefinition{Type: "other"},
+			discount: 100,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     100,
+			wantOK:   true,
+		},
+		{
+			name:     "max_discount caps flat",
+			def:      CouponDefinition{Type: CouponTypeFlat, MaxDiscount: intPtr(250)},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     250,
+			wantOK:   true,
+		},
+		{
+			name:   "max_discount caps percent",
+			def:    CouponDefinition{Type: CouponTypePercent, Percent: intPtr(50), MaxDiscount: intPtr(300)},
+			ctx:    couponContext{Fare: 1500, MeteredFare: 1000},
+			want:   300,
+			wantOK: true,
+		},
+		{
+			name:   "max_discount above the discount has no effect",
+			def:    CouponDefinition{Type: CouponTypePercent, Percent: intPtr(10), MaxDiscount: intPtr(300)},
+			ctx:    couponContext{Fare: 1500, MeteredFare: 1000},
+			want:   100,
+			wantOK: true,
+		},
+		{
+			name:     "below min_fare",
+			def:      CouponDefinition{Type: CouponTypeFlat, MinFare: 1501},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     0,
+			wantOK:   false,
+		},
+		{
+			name:     "exactly min_fare",
+			def:      CouponDefinition{Type: CouponTypeFlat, MinFare: 1500},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     300,
+			wantOK:   true,
+		},
+		{
+			name:     "first_ride_only on the first ride",
+			def:      CouponDefinition{Type: CouponTypeFlat, FirstRideOnly: true},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000, FirstRide: true},
+			want:     300,
+			wantOK:   true,
+		},
+		{
+			name:     "first_ride_only after the first ride",
+			def:      CouponDefinition{Type: CouponTypeFlat, FirstRideOnly: true},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000, FirstRide: false},
+			want:     0,
+			wantOK:   false,
+		},
+		{
+			name:     "max_uses reached",
+			def:      CouponDefinition{Name: couponDefinitionNew2024, Type: CouponTypeFlat, MaxUses: intPtr(1)},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000, Uses: map[string]int{couponDefinitionNew2024: 1}},
+			want:     0,
+			wantOK:   false,
+		},
+		{
+			name:     "max_uses not reached",
+			def:      CouponDefinition{Name: couponDefinitionNew2024, Type: CouponTypeFlat, MaxUses: intPtr(2)},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000, Uses: map[string]int{couponDefinitionNew2024: 1}},
+			want:     300,
+			wantOK:   true,
+		},
+		{
+			name:     "campaign expired",
+			def:      CouponDefinition{Type: CouponTypeFlat, ExpiresAt: &past},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     0,
+			wantOK:   false,
+		},
+		{
+			name:     "campaign not expired",
+			def:      CouponDefinition{Type: CouponTypeFlat, ExpiresAt: &future},
+			discount: 300,
+			ctx:      couponContext{Fare: 1500, MeteredFare: 1000},
+			want:     300,
+			wantOK:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.ctx
+			c.Now = now
+			got, ok := tt.def.discount(&Coupon{Discount: tt.discount}, &c)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("discount() = (%d, %v), want (%d, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCouponDefinitionOf(t *testing.T) {
+	defs := map[string]*CouponDefinition{
+		couponDefinitionNew2024:  {Name: couponDefinitionNew2024, Type: CouponTypeFlat},
+		couponDefinitionFallback: {Name: couponDefinitionFallback, Type: CouponTypeFlat},
+	}
+	if got := couponDefinitionOf(defs, &Coupon{Definition: couponDefinitionNew2024}); got.Name != couponDefinitionNew2024 {
+		t.Errorf("couponDefinitionOf(known) = %s, want %s", got.Name, couponDefinitionNew2024)
+	}
+	if got := couponDefinitionOf(defs, &Coupon{Definition: "UNKNOWN"}); got.Name != couponDefinitionFallback {
+		t.Errorf("couponDefinitionOf(unknown) = %s, want %s", got.Name, couponDefinitionFallback)
+	}
+	if got := couponDefinitionOf(map[string]*CouponDefinition{}, &Coupon{Definition: "UNKNOWN"}); got.Type != CouponTypeFlat {
+		t.Errorf("couponDefinitionOf(no definitions) = %s, want %s", got.Type, CouponTypeFlat)
+	}
+}
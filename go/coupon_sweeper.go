@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CouponSweeper は有効期限を過ぎた未使用のクーポンを定期的に期限切れとして記録する
+type CouponSweeper struct {
+	db       *sqlx.DB
+	interval time.Duration
+}
+
+func NewCouponSweeper(db *sqlx.DB, interval time.Duration) (*CouponSweeper, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid coupon sweep interval: %s", interval)
+	}
+	return &CouponSweeper{db: db, interval: interval}, nil
+}
+
+// Start はバックグラウンドで期限切れの処理を開始する
+func (s *CouponSweeper) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n, err := s.RunOnce(ctx)
+				if err != nil {
+					slog.Error("failed to sweep expired coupons", "error", err)
+					continue
+				}
+				if n > 0 {
+					slog.Info("swept expired coupons", "count", n)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RunOnce は期限切れのクーポンを記録し、その件数を返す
+func (s *CouponSweeper) RunOnce(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(
+		ctx,
+		`UPDATE coupons SET expired_at = NOW(6) WHERE used_by IS NULL AND expired_at IS NULL AND expires_at <= NOW(6)`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire coupons: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -1,92 +1,175 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
-// このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
+type internalGetMatchingResponse struct {
+	Matchings []Matching `json:"matchings"`
+}
+
+// マッチングはバックグラウンドのMatchingEngineが一定間隔で行う
+// このAPIは手動でマッチングを1回実行し、成立した割り当てを返す
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	tx, err := db.Beginx()
+	matchings, err := matchingEngine.RunOnce(ctx)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err))
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to run matching: %w", err))
 		return
 	}
-	defer tx.Rollback()
 
-	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
+	writeJSON(w, http.StatusOK, &internalGetMatchingResponse{
+		Matchings: matchings,
+	})
+}
+
+type internalGetPaymentJobsResponse struct {
+	Jobs []*PaymentJob `json:"jobs"`
+}
+
+// internalGetPaymentJobs は決済要求の一覧を返す。status を省略した場合は dead の要求を返す
+func internalGetPaymentJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = PaymentJobStatusDead
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
 			return
 		}
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride: %w", err))
+		limit = n
+	}
+
+	jobs, err := paymentWorker.Jobs(ctx, status, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get payment jobs: %w", err))
 		return
 	}
 
-	// 利用可能な椅子を効率的に取得（例：最も近い椅子）
-	query := `
-        WITH active_chairs AS (SELECT
-        c.id,
-        c.speed,
-        cl.latitude,
-        cl.longitude
-    	FROM chairs c
-    	JOIN chair_locations cl ON c.id = cl.chair_id
-    	WHERE c.is_active = TRUE
-    	AND NOT EXISTS (
-			SELECT 1
-			FROM rides r
-			JOIN ride_statuses rs ON r.id = rs.ride_id
-			WHERE r.chair_id = c.id
-    		AND rs.status != 'COMPLETED'
-    	)
-	),
-	chair_distances AS (
-		SELECT
-			ac.id AS chair_id,
-			ABS(ac.latitude - ?) + ABS(ac.longitude - ?) AS manhattan_distance,
-			ac.speed
-		FROM active_chairs ac
-	),
-	chair_times AS (
-		SELECT
-			chair_id,
-			manhattan_distance,
-			manhattan_distance / NULLIF(speed, 0) AS estimated_time
-		FROM chair_distances
-	)
-	SELECT chair_id
-	FROM chair_times
-	WHERE estimated_time IS NOT NULL
-	ORDER BY estimated_time ASC
-	LIMIT 1;
-    `
-
-	matched := &Chair{}
-	if err := tx.GetContext(ctx, matched, query, ride.PickupLatitude, ride.PickupLongitude); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
+	writeJSON(w, http.StatusOK, &internalGetPaymentJobsResponse{
+		Jobs: jobs,
+	})
+}
+
+// internalPostPaymentJobRedrive は dead になった決済要求を再び配信待ちに戻す
+func internalPostPaymentJobRedrive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	jobID := r.PathValue("job_id")
+
+	ok, err := paymentWorker.Redrive(ctx, jobID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to redrive payment job: %w", err))
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("dead payment job not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalGetRefundsResponse struct {
+	Refunds []*Refund `json:"refunds"`
+}
+
+// internalGetRefunds は返金の一覧を返す。status を省略した場合は結果が分からないまま再送を諦めた返金を返す
+func internalGetRefunds(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = RefundStatusUnknown
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
 			return
 		}
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get chair: %w", err))
-		return
+		limit = n
 	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to update ride: %w", err))
+	refunds, err := refundReconciler.Refunds(ctx, status, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get refunds: %w", err))
 		return
 	}
 
-	// トランザクションをコミット
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit transaction: %w", err))
+	writeJSON(w, http.StatusOK, &internalGetRefundsResponse{
+		Refunds: refunds,
+	})
+}
+
+// internalPostRefundRedrive は結果が分からないまま再送を諦めた返金を、同じ冪等キーで再送させる
+func internalPostRefundRedrive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	refundID := r.PathValue("refund_id")
+
+	ok, err := refundReconciler.Redrive(ctx, refundID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to redrive refund: %w", err))
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown refund not found"))
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+type internalGetPaymentGatewayResponse struct {
+	Breaker CircuitBreakerState `json:"breaker"`
+}
+
+// internalGetPaymentGateway は決済マイクロサービスのクライアントの状態を返す
+func internalGetPaymentGateway(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalGetPaymentGatewayResponse{
+		Breaker: paymentGateway.BreakerState(),
+	})
+}
+
+// internalPostRideRefund は運営としてライドの決済を返金する
+func internalPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	req := &ownerPostRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("amount must be positive"))
+		return
+	}
+	if req.CouponDiscount < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("coupon_discount must not be negative"))
+		return
+	}
+
+	refund, err := refundRide(ctx, paymentGateway, &RefundRequest{
+		RideID:         rideID,
+		Amount:         req.Amount,
+		Reason:         req.Reason,
+		RequestedBy:    refundRequestedByOperator,
+		CouponDiscount: req.CouponDiscount,
+	})
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, refund)
+}
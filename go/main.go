@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -24,6 +26,20 @@ var (
 	chairDistanceRepo *ChairDistanceRepository
 	chairRepo         *ChairRepository
 	userRepository    *UserRepository
+	matchingEngine    *MatchingEngine
+	pricer            *Pricer
+	chairStateIndex   *ChairStateIndex
+	paymentWorker     *PaymentWorker
+	paymentGateway    *PaymentGatewayClient
+	couponSweeper     *CouponSweeper
+	refundReconciler  *RefundReconciler
+	rideStateMachine  = NewRideStateMachine()
+
+	// operatorToken は運営向けのAPIの共有シークレット
+	operatorToken string
+
+	userNotificationHub  *NotificationHub
+	chairNotificationHub *NotificationHub
 )
 
 func initCache() {
@@ -99,11 +115,69 @@ func setup() http.Handler {
 	if err != nil {
 		panic(err)
 	}
+
+	userNotificationHub = NewNotificationHub(64)
+	chairNotificationHub = NewNotificationHub(64)
+
+	chairStateIndex, err = NewChairStateIndex(db)
+	if err != nil {
+		panic(err)
+	}
+	if err := chairStateIndex.Rebuild(context.Background()); err != nil {
+		panic(err)
+	}
+
+	pricer, err = NewPricer(db, chairStateIndex)
+	if err != nil {
+		panic(err)
+	}
+
+	matchingInterval := envDurationMs("ISUCON_MATCHING_INTERVAL_MS", 250*time.Millisecond)
+	matchingEngine, err = NewMatchingEngine(db, chairStateIndex, matchingInterval, os.Getenv("ISUCON_MATCHING_POLICY"))
+	if err != nil {
+		panic(err)
+	}
+	matchingEngine.Start(context.Background())
+
+	paymentConcurrency := 8
+	if v := os.Getenv("ISUCON_PAYMENT_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			panic(fmt.Sprintf("failed to convert payment concurrency from ISUCON_PAYMENT_CONCURRENCY environment variable into int: %v", err))
+		}
+		paymentConcurrency = n
+	}
+	paymentGateway = NewPaymentGatewayClient(PaymentGatewayConfig{
+		ConnectTimeout:   envDurationMs("ISUCON_PAYMENT_CONNECT_TIMEOUT_MS", 1*time.Second),
+		ReadTimeout:      envDurationMs("ISUCON_PAYMENT_READ_TIMEOUT_MS", 3*time.Second),
+		FailureThreshold: 5,
+		OpenTimeout:      envDurationMs("ISUCON_PAYMENT_BREAKER_OPEN_MS", 2*time.Second),
+	})
+	paymentWorker, err = NewPaymentWorker(db, paymentGateway, paymentConcurrency)
+	if err != nil {
+		panic(err)
+	}
+	paymentWorker.Start(context.Background())
+
+	couponSweeper, err = NewCouponSweeper(db, envDurationMs("ISUCON_COUPON_SWEEP_INTERVAL_MS", 1*time.Minute))
+	if err != nil {
+		panic(err)
+	}
+	couponSweeper.Start(context.Background())
+
+	refundReconciler, err = NewRefundReconciler(db, paymentGateway, envDurationMs("ISUCON_REFUND_RECONCILE_INTERVAL_MS", 5*time.Second))
+	if err != nil {
+		panic(err)
+	}
+	refundReconciler.Start(context.Background())
+
 	//chairLocationRepo, err = NewChairLocationRepository(db.DB)
 	//if err != nil {
 	//	panic(err)
 	//}
 
+	operatorToken = os.Getenv("ISUCON_OPERATOR_TOKEN")
+
 	mux := chi.NewRouter()
 	mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
@@ -114,11 +188,17 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/app/users", appPostUsers)
 
 		authedMux := mux.With(appAuthMiddleware)
+		authedMux.HandleFunc("GET /api/app/payment-methods", appGetPaymentMethods)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
+		authedMux.HandleFunc("POST /api/app/payment-methods/{payment_method_id}/default", appPostPaymentMethodDefault)
+		authedMux.HandleFunc("DELETE /api/app/payment-methods/{payment_method_id}", appDeletePaymentMethod)
+		authedMux.HandleFunc("GET /api/app/coupons", appGetCoupons)
+		authedMux.HandleFunc("GET /api/app/invitations", appGetInvitations)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
@@ -129,7 +209,18 @@ func setup() http.Handler {
 
 		authedMux := mux.With(ownerAuthMiddleware)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/timeseries", ownerGetSalesTimeseries)
+		authedMux.HandleFunc("GET /api/owner/sales/export", ownerGetSalesExport)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/deactivate", ownerPostChairDeactivate)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/enable", ownerPostChairEnable)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/retire", ownerPostChairRetire)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/transfer", ownerPostChairTransfer)
+		authedMux.HandleFunc("GET /api/owner/chair-register-tokens", ownerGetChairRegisterTokens)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens", ownerPostChairRegisterToken)
+		authedMux.HandleFunc("DELETE /api/owner/chair-register-tokens/{token_id}", ownerDeleteChairRegisterToken)
+		authedMux.HandleFunc("POST /api/owner/rides/{ride_id}/refund", ownerPostRideRefund)
 	}
 
 	// chair handlers
@@ -146,11 +237,33 @@ func setup() http.Handler {
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+
+		// 決済を操作するAPIは運営だけが使える
+		operatorMux := mux.With(operatorAuthMiddleware)
+		operatorMux.HandleFunc("GET /api/internal/payment-gateway", internalGetPaymentGateway)
+		operatorMux.HandleFunc("GET /api/internal/payment-jobs", internalGetPaymentJobs)
+		operatorMux.HandleFunc("POST /api/internal/payment-jobs/{job_id}/redrive", internalPostPaymentJobRedrive)
+		operatorMux.HandleFunc("POST /api/internal/rides/{ride_id}/refund", internalPostRideRefund)
+		operatorMux.HandleFunc("GET /api/internal/refunds", internalGetRefunds)
+		operatorMux.HandleFunc("POST /api/internal/refunds/{refund_id}/redrive", internalPostRefundRedrive)
 	}
 
 	return mux
 }
 
+// envDurationMs は環境変数をミリ秒として読み込む。未設定なら defaultValue を返す
+func envDurationMs(name string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert %s environment variable into int: %v", name, err))
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 type postInitializeRequest struct {
 	PaymentServer string `json:"payment_server"`
 }
@@ -177,6 +290,11 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := chairStateIndex.Rebuild(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to rebuild chair state index: %w", err))
+		return
+	}
+
 	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
 }
 
@@ -211,7 +329,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "error", err)
 }
 
 func secureRandomStr(b int) string {
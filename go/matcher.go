@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+const (
+	matchingPolicyGreedy   = "greedy"
+	matchingPolicyETA      = "eta"
+	matchingPolicyFairness = "fairness"
+
+	defaultMatchingPolicy = matchingPolicyETA
+
+	// matchingDeclinedCost は辞退済みの組み合わせのコスト。どの到着見込み時間よりも十分大きくする
+	matchingDeclinedCost = 1e12
+)
+
+// Matcher は未割り当てのライドと空いている椅子から割り当てを決める戦略
+// rides は作成日時の古い順に並んでいる。ライドを辞退した椅子はそのライドに割り当てない
+type Matcher interface {
+	Match(rides []matchingRide, chairs []matchingChair) []Matching
+}
+
+// newMatcher はポリシー名に対応するMatcherを返す
+func newMatcher(policy string) (Matcher, error) {
+	switch policy {
+	case matchingPolicyGreedy:
+		return &greedyNearestMatcher{}, nil
+	case matchingPolicyETA:
+		return &etaMatcher{}, nil
+	case matchingPolicyFairness:
+		return &fairnessMatcher{slack: 1.5}, nil
+	default:
+		return nil, fmt.Errorf("unknown matching policy: %s", policy)
+	}
+}
+
+// estimatedTime は椅子が配車位置に到着するまでの見込み時間
+func estimatedTime(ride matchingRide, chair matchingChair) float64 {
+	distance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, chair.Latitude, chair.Longitude)
+	return float64(distance) / float64(chair.Speed)
+}
+
+// greedyNearestMatcher は古いライドから順に、最も近い(マンハッタン距離)椅子を割り当てる
+type greedyNearestMatcher struct{}
+
+func (m *greedyNearestMatcher) Match(rides []matchingRide, chairs []matchingChair) []Matching {
+	used := make([]bool, len(chairs))
+	matchings := []Matching{}
+	for _, ride := range rides {
+		best := -1
+		bestDistance := math.MaxInt
+		for j, chair := range chairs {
+			if used[j] || ride.declined(chair.ID) {
+				continue
+			}
+			distance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, chair.Latitude, chair.Longitude)
+			if distance < bestDistance {
+				best = j
+				bestDistance = distance
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		used[best] = true
+		matchings = append(matchings, Matching{RideID: ride.ID, ChairID: chairs[best].ID})
+	}
+	return matchings
+}
+
+// etaMatcher は到着見込み時間(距離/速度)の総和が最小になるよう全体で割り当てる
+type etaMatcher struct{}
+
+func (m *etaMatcher) Match(rides []matchingRide, chairs []matchingChair) []Matching {
+	// 全ての椅子に辞退されたライドは、割り当て枠を使わないよう先に除く
+	matchable := make([]matchingRide, 0, len(rides))
+	for _, ride := range rides {
+		if slices.ContainsFunc(chairs, func(c matchingChair) bool { return !ride.declined(c.ID) }) {
+			matchable = append(matchable, ride)
+		}
+	}
+	rides = matchable
+
+	// 椅子が足りない場合は古いライドから優先的に割り当てる
+	if len(rides) > len(chairs) {
+		rides = rides[:len(chairs)]
+	}
+
+	cost := make([][]float64, len(rides))
+	for i, ride := range rides {
+		cost[i] = make([]float64, len(chairs))
+		for j, chair := range chairs {
+			if ride.declined(chair.ID) {
+				cost[i][j] = matchingDeclinedCost
+				continue
+			}
+			cost[i][j] = estimatedTime(ride, chair)
+		}
+	}
+
+	assigned := minCostAssignment(cost)
+	matchings := make([]Matching, 0, len(assigned))
+	for i, j := range assigned {
+		// 辞退済みの組み合わせしか残らなかったライドは割り当てない
+		if rides[i].declined(chairs[j].ID) {
+			continue
+		}
+		matchings = append(matchings, Matching{RideID: rides[i].ID, ChairID: chairs[j].ID})
+	}
+	return matchings
+}
+
+// fairnessMatcher は古いライドから順に、到着見込み時間が最短の slack 倍以内に収まる椅子のうち
+// 最も長く待機している椅子を割り当てる
+type fairnessMatcher struct {
+	slack float64
+}
+
+func (m *fairnessMatcher) Match(rides []matchingRide, chairs []matchingChair) []Matching {
+	// 待機時間の長い順に並べておき、候補の中で最初に見つかった椅子を選ぶ
+	order := make([]int, len(chairs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return chairs[order[a]].IdleSince.Before(chairs[order[b]].IdleSince)
+	})
+
+	used := make([]bool, len(chairs))
+	matchings := []Matching{}
+	for _, ride := range rides {
+		bestTime := math.Inf(1)
+		for j, chair := range chairs {
+			if !used[j] && !ride.declined(chair.ID) {
+				bestTime = min(bestTime, estimatedTime(ride, chair))
+			}
+		}
+		if math.IsInf(bestTime, 1) {
+			continue
+		}
+
+		// 同じ場所にいる場合でも多少の遠回りは許容する
+		limit := max(bestTime*m.slack, bestTime+1)
+		for _, j := range order {
+			if used[j] || ride.declined(chairs[j].ID) || estimatedTime(ride, chairs[j]) > limit {
+				continue
+			}
+			used[j] = true
+			matchings = append(matchings, Matching{RideID: ride.ID, ChairID: chairs[j].ID})
+			break
+		}
+	}
+	return matchings
+}
+
+// minCostAssignment は n×m (n <= m) のコスト行列に対して総コスト最小の割り当て(ハンガリアン法)を求め、
+// 各行に割り当てた列のインデックスを返す
+func minCostAssignment(cost [][]float64) []int {
+	n := len(cost)
+	if n == 0 {
+		return []int{}
+	}
+	m := len(cost[0])
+
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+	minv := make([]float64, m+1)
+	used := make([]bool, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = math.Inf(1)
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assigned := make([]int, n)
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			assigned[p[j]-1] = j - 1
+		}
+	}
+	return assigned
+}
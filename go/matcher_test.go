@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// assignmentCost は割り当ての総コストを返す
+func assignmentCost(cost [][]float64, assigned []int) float64 {
+	total := 0.0
+	for i, j := range assigned {
+		total += cost[i][j]
+	}
+	return total
+}
+
+// bruteForceAssignment は全ての割り当てを試して最小の総コストを返す
+func bruteForceAssignment(cost [][]float64) float64 {
+	n := len(cost)
+	if n == 0 {
+		return 0
+	}
+	used := make([]bool, len(cost[0]))
+	best := math.Inf(1)
+	var search func(i int, total float64)
+	search = func(i int, total float64) {
+		if i == n {
+			best = min(best, total)
+			return
+		}
+		for j := range used {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			search(i+1, total+cost[i][j])
+			used[j] = false
+		}
+	}
+	search(0, 0)
+	return best
+}
+
+// assertValidAssignment は各行に異なる列が割り当てられていることを確認する
+func assertValidAssignment(t *testing.T, cost [][]float64, assigned []int) {
+	t.Helper()
+	if len(assigned) != len(cost) {
+		t.Fatalf("assigned %d rows, want %d", len(assigned), len(cost))
+	}
+	seen := map[int]bool{}
+	for i, j := range assigned {
+		if j < 0 || j >= len(cost[i]) {
+			t.Fatalf("row %d assigned to out of range column %d", i, j)
+		}
+		if seen[j] {
+			t.Fatalf("column %d assigned twice: %v", j, assigned)
+		}
+		seen[j] = true
+	}
+}
+
+func TestMinCostAssignment(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]float64
+		want []int
+	}{
+		{
+			name: "empty",
+			cost: [][]float64{},
+			want: []int{},
+		},
+		{
+			name: "square",
+			cost: [][]float64{
+				{4, 1, 3},
+				{2, 0, 5},
+				{3, 2, 2},
+			},
+			want: []int{1, 0, 2},
+		},
+		{
+			name: "more columns than rows",
+			cost: [][]float64{
+				{9, 9, 1, 9},
+				{9, 2, 9, 9},
+			},
+			want: []int{2, 1},
+		},
+		{
+			name: "greedy choice is not optimal",
+			cost: [][]float64{
+				{1, 2},
+				{2, 100},
+			},
+			want: []int{1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := minCostAssignment(tt.cost)
+			assertValidAssignment(t, tt.cost, got)
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("minCostAssignment() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMinCostAssignmentTies(t *testing.T) {
+	cost := [][]float64{
+		{1, 1, 1},
+		{1, 1, 1},
+		{1, 1, 1},
+	}
+	got := minCostAssignment(cost)
+	assertValidAssignment(t, cost, got)
+	if total := assignmentCost(cost, got); total != 3 {
+		t.Fatalf("total cost = %v, want 3", total)
+	}
+}
+
+func TestMinCostAssignmentMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 500 {
+		n := r.IntN(5) + 1
+		m := n + r.IntN(3)
+		cost := make([][]float64, n)
+		for i := range cost {
+			cost[i] = make([]float64, m)
+			for j := range cost[i] {
+				// 同じコストが出やすいよう小さい整数にする
+				cost[i][j] = float64(r.IntN(10))
+			}
+		}
+
+		got := minCostAssignment(cost)
+		assertValidAssignment(t, cost, got)
+		if total, want := assignmentCost(cost, got), bruteForceAssignment(cost); total != want {
+			t.Fatalf("cost %v: total cost = %v, want %v", cost, total, want)
+		}
+	}
+}
+
+func TestETAMatcherMoreRidesThanChairs(t *testing.T) {
+	rides := []matchingRide{
+		{ID: "ride1", PickupLatitude: 0, PickupLongitude: 0},
+		{ID: "ride2", PickupLatitude: 10, PickupLongitude: 10},
+		{ID: "ride3", PickupLatitude: 20, PickupLongitude: 20},
+	}
+	chairs := []matchingChair{
+		{ID: "chair1", Speed: 1, Latitude: 10, Longitude: 10},
+		{ID: "chair2", Speed: 1, Latitude: 0, Longitude: 0},
+	}
+
+	got := (&etaMatcher{}).Match(rides, chairs)
+	// 椅子が足りない場合は古いライドから割り当てる
+	want := map[string]string{"ride1": "chair2", "ride2": "chair1"}
+	if len(got) != len(want) {
+		t.Fatalf("Match() = %v, want %v", got, want)
+	}
+	for _, m := range got {
+		if want[m.RideID] != m.ChairID {
+			t.Fatalf("Match() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestETAMatcherMoreChairsThanRides(t *testing.T) {
+	rides := []matchingRide{
+		{ID: "ride1", PickupLatitude: 0, PickupLongitude: 0},
+	}
+	chairs := []matchingChair{
+		{ID: "chair1", Speed: 1, Latitude: 30, Longitude: 0},
+		{ID: "chair2", Speed: 1, Latitude: 20, Longitude: 0},
+		// 遠いが速いので先に着く
+		{ID: "chair3", Speed: 10, Latitude: 50, Longitude: 0},
+	}
+
+	got := (&etaMatcher{}).Match(rides, chairs)
+	if len(got) != 1 || got[0].ChairID != "chair3" {
+		t.Fatalf("Match() = %v, want ride1 assigned to chair3", got)
+	}
+}
+
+func TestMatchersSkipDeclinedChairs(t *testing.T) {
+	rides := []matchingRide{
+		{ID: "ride1", PickupLatitude: 0, PickupLongitude: 0, DeclinedBy: map[string]struct{}{"chair1": {}}},
+		{ID: "ride2", PickupLatitude: 100, PickupLongitude: 100, DeclinedBy: map[string]struct{}{"chair1": {}, "chair2": {}}},
+		{ID: "ride3", PickupLatitude: 50, PickupLongitude: 50},
+	}
+	chairs := []matchingChair{
+		// ride1 の目の前にいるが、ride1 と ride2 を辞退している
+		{ID: "chair1", Speed: 1, Latitude: 0, Longitude: 0},
+		{ID: "chair2", Speed: 1, Latitude: 10, Longitude: 10},
+	}
+
+	for _, policy := range []string{matchingPolicyGreedy, matchingPolicyETA, matchingPolicyFairness} {
+		t.Run(policy, func(t *testing.T) {
+			matcher, err := newMatcher(policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := matcher.Match(rides, chairs)
+			want := map[string]string{"ride1": "chair2", "ride3": "chair1"}
+			if len(got) != len(want) {
+				t.Fatalf("Match() = %v, want %v", got, want)
+			}
+			for _, m := range got {
+				if want[m.RideID] != m.ChairID {
+					t.Fatalf("Match() = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
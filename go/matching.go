@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Matching はライドと椅子の割り当て結果
+type Matching struct {
+	RideID  string `json:"ride_id"`
+	ChairID string `json:"chair_id"`
+}
+
+type matchingRide struct {
+	ID              string `db:"id"`
+	UserID          string `db:"user_id"`
+	PickupLatitude  int    `db:"pickup_latitude"`
+	PickupLongitude int    `db:"pickup_longitude"`
+	// Tier は見積もりで指定された料金ティア。空ならどのティアの椅子でもよい
+	Tier      string    `db:"tier"`
+	CreatedAt time.Time `db:"created_at"`
+	// DeclinedBy はこのライドを辞退した椅子。これらの椅子には割り当てない
+	DeclinedBy map[string]struct{} `db:"-"`
+}
+
+// declined は椅子がこのライドを辞退済みかどうかを返す
+func (r *matchingRide) declined(chairID string) bool {
+	_, ok := r.DeclinedBy[chairID]
+	return ok
+}
+
+type matchingChair struct {
+	ID        string
+	Speed     int
+	Latitude  int
+	Longitude int
+	Tier      string
+	IdleSince time.Time
+}
+
+const (
+	// 1ライドあたりに確保したい候補椅子の数
+	matchingCandidatesPerRide = 8
+	// 候補椅子を探す初期半径と最大半径
+	matchingSearchRadius    = 50
+	matchingMaxSearchRadius = 800
+)
+
+// MatchingEngine は未割り当てのライドと空いている椅子を一定間隔でまとめてマッチングする
+// 割り当て方法は環境変数 ISUCON_MATCHING_POLICY、未設定なら settings テーブルの matching_policy で選択する
+type MatchingEngine struct {
+	db       *sqlx.DB
+	index    *ChairStateIndex
+	interval time.Duration
+	policy   string
+	matchers map[string]Matcher
+	mutex    sync.Mutex
+}
+
+func NewMatchingEngine(db *sqlx.DB, index *ChairStateIndex, interval time.Duration, policy string) (*MatchingEngine, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid matching interval: %s", interval)
+	}
+
+	matchers := map[string]Matcher{}
+	for _, name := range []string{matchingPolicyGreedy, matchingPolicyETA, matchingPolicyFairness} {
+		m, err := newMatcher(name)
+		if err != nil {
+			return nil, err
+		}
+		matchers[name] = m
+	}
+	if policy != "" {
+		if _, ok := matchers[policy]; !ok {
+			return nil, fmt.Errorf("unknown matching policy: %s", policy)
+		}
+	}
+
+	return &MatchingEngine{
+		db:       db,
+		index:    index,
+		interval: interval,
+		policy:   policy,
+		matchers: matchers,
+	}, nil
+}
+
+// currentMatcher は現在有効なMatcherを返す
+// settings テーブルの値は毎回参照するので、再起動せずにポリシーを切り替えられる
+func (e *MatchingEngine) currentMatcher(ctx context.Context) (Matcher, error) {
+	policy := e.policy
+	if policy == "" {
+		if err := e.db.GetContext(ctx, &policy, "SELECT value FROM settings WHERE name = 'matching_policy'"); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+			policy = defaultMatchingPolicy
+		}
+	}
+
+	m, ok := e.matchers[policy]
+	if !ok {
+		slog.Warn("unknown matching policy, falling back to default", "policy", policy)
+		return e.matchers[defaultMatchingPolicy], nil
+	}
+	return m, nil
+}
+
+// Start はバックグラウンドでマッチングループを開始する
+func (e *MatchingEngine) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := e.RunOnce(ctx); err != nil {
+					slog.Error("failed to run matching", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RunOnce は1回分のマッチングを行い、成立した割り当てを返す
+// 全ての割り当ては1つのトランザクションで書き込む
+func (e *MatchingEngine) RunOnce(ctx context.Context) ([]Matching, error) {
+	// 手動トリガーとバックグラウンドループが同じ椅子を二重に割り当てないよう直列化する
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	rides := []matchingRide{}
+	if err := e.db.SelectContext(ctx, &rides, `
+		SELECT rides.id, rides.user_id, rides.pickup_latitude, rides.pickup_longitude, COALESCE(pq.tier, '') AS tier, rides.created_at
+		FROM rides
+		LEFT JOIN price_quotes pq ON pq.ride_id = rides.id
+		WHERE rides.chair_id IS NULL
+		AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status = 'CANCELED')
+		ORDER BY rides.created_at
+	`); err != nil {
+		return nil, fmt.Errorf("failed to select rides: %w", err)
+	}
+	if len(rides) == 0 {
+		return []Matching{}, nil
+	}
+	if err := e.loadDeclines(ctx, rides); err != nil {
+		return nil, err
+	}
+
+	chairs := e.candidateChairs(rides)
+	if len(chairs) == 0 {
+		return []Matching{}, nil
+	}
+
+	matcher, err := e.currentMatcher(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get matching policy: %w", err)
+	}
+	assigned := matchByTier(matcher, rides, chairs)
+
+	tx, err := e.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	matchings := make([]Matching, 0, len(assigned))
+	for _, a := range assigned {
+		// インデックスを読んでから書き込むまでの間に椅子が停止・引退している場合があるので、DBの状態でも確認する
+		result, err := tx.ExecContext(ctx, `
+			UPDATE rides SET chair_id = ?
+			WHERE id = ? AND chair_id IS NULL
+			AND EXISTS (SELECT 1 FROM chairs WHERE id = ? AND is_active = TRUE AND retired_at IS NULL)
+		`, a.ChairID, a.RideID, a.ChairID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update ride: %w", err)
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("failed to get affected rows: %w", err)
+		} else if count == 0 {
+			// 他の処理で既に割り当て済みか、椅子が割り当てられない状態になった
+			continue
+		}
+		matchings = append(matchings, a)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	userIDs := make(map[string]string, len(rides))
+	for _, ride := range rides {
+		userIDs[ride.ID] = ride.UserID
+	}
+	for _, m := range matchings {
+		e.index.SetRideStatus(m.ChairID, m.RideID, RideStatusMatching)
+		// ステータスは MATCHING のままだが、椅子が決まったことを通知する
+		publishRideEvent(&RideEvent{
+			RideID:  m.RideID,
+			UserID:  userIDs[m.RideID],
+			ChairID: m.ChairID,
+			Status:  RideStatusMatching,
+		})
+	}
+
+	return matchings, nil
+}
+
+// loadDeclines は未割り当てのライドを辞退した椅子を読み込む
+func (e *MatchingEngine) loadDeclines(ctx context.Context, rides []matchingRide) error {
+	declines := []struct {
+		RideID  string `db:"ride_id"`
+		ChairID string `db:"chair_id"`
+	}{}
+	if err := e.db.SelectContext(ctx, &declines, `
+		SELECT ride_declines.ride_id, ride_declines.chair_id
+		FROM ride_declines
+		JOIN rides ON rides.id = ride_declines.ride_id
+		WHERE rides.chair_id IS NULL
+	`); err != nil {
+		return fmt.Errorf("failed to select ride declines: %w", err)
+	}
+
+	byRide := make(map[string]map[string]struct{}, len(declines))
+	for _, d := range declines {
+		if _, ok := byRide[d.RideID]; !ok {
+			byRide[d.RideID] = map[string]struct{}{}
+		}
+		byRide[d.RideID][d.ChairID] = struct{}{}
+	}
+	for i := range rides {
+		rides[i].DeclinedBy = byRide[rides[i].ID]
+	}
+	return nil
+}
+
+// candidateChairs はインデックスから割り当て候補の椅子を取得する
+// 空いている椅子が多い場合は、各ライドの配車位置の近くにいる椅子だけに絞り込む
+func (e *MatchingEngine) candidateChairs(rides []matchingRide) []matchingChair {
+	states := e.index.FreeChairs()
+	if len(states) > len(rides)*matchingCandidatesPerRide {
+		seen := map[string]struct{}{}
+		narrowed := []chairState{}
+		for _, ride := range rides {
+			for radius := matchingSearchRadius; ; radius *= 2 {
+				nearby := e.index.NearbyFreeChairs(ride.PickupLatitude, ride.PickupLongitude, radius)
+				if len(nearby) < matchingCandidatesPerRide && radius < matchingMaxSearchRadius {
+					continue
+				}
+				for _, s := range nearby {
+					if ride.declined(s.ID) {
+						continue
+					}
+					if _, ok := seen[s.ID]; !ok {
+						seen[s.ID] = struct{}{}
+						narrowed = append(narrowed, s)
+					}
+				}
+				break
+			}
+		}
+		if len(narrowed) > 0 {
+			states = narrowed
+		}
+	}
+
+	chairs := make([]matchingChair, 0, len(states))
+	for _, s := range states {
+		if s.Speed <= 0 {
+			continue
+		}
+		chairs = append(chairs, matchingChair{
+			ID:        s.ID,
+			Speed:     s.Speed,
+			Latitude:  s.Latitude,
+			Longitude: s.Longitude,
+			Tier:      s.Tier,
+			IdleSince: s.IdleSince,
+		})
+	}
+	sort.Slice(chairs, func(i, j int) bool { return chairs[i].ID < chairs[j].ID })
+	return chairs
+}
+
+// matchByTier は料金ティアを指定したライドにそのティアの椅子だけを割り当てる
+// ティアを指定したライドを先に割り当て、残った椅子をティアを指定していないライドに割り当てる
+func matchByTier(matcher Matcher, rides []matchingRide, chairs []matchingChair) []Matching {
+	ridesByTier := map[string][]matchingRide{}
+	tiers := []string{}
+	for _, ride := range rides {
+		if _, ok := ridesByTier[ride.Tier]; !ok && ride.Tier != "" {
+			tiers = append(tiers, ride.Tier)
+		}
+		ridesByTier[ride.Tier] = append(ridesByTier[ride.Tier], ride)
+	}
+	if len(tiers) == 0 {
+		return matcher.Match(rides, chairs)
+	}
+
+	assigned := []Matching{}
+	used := map[string]struct{}{}
+	for _, tier := range tiers {
+		candidates := []matchingChair{}
+		for _, c := range chairs {
+			if c.Tier == tier {
+				candidates = append(candidates, c)
+			}
+		}
+		for _, m := range matcher.Match(ridesByTier[tier], candidates) {
+			assigned = append(assigned, m)
+			used[m.ChairID] = struct{}{}
+		}
+	}
+
+	if untiered := ridesByTier[""]; len(untiered) > 0 {
+		remaining := []matchingChair{}
+		for _, c := range chairs {
+			if _, ok := used[c.ID]; !ok {
+				remaining = append(remaining, c)
+			}
+		}
+		assigned = append(assigned, matcher.Match(untiered, remaining)...)
+	}
+	return assigned
+}
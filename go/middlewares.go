@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -83,3 +84,20 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// operatorAuthMiddleware は運営向けのAPIを X-Operator-Token ヘッダーの共有シークレットで保護する
+// シークレット(ISUCON_OPERATOR_TOKEN)が設定されていない場合は全てのリクエストを拒否する
+func operatorAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Operator-Token")
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, errors.New("X-Operator-Token header is required"))
+			return
+		}
+		if operatorToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(operatorToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid operator token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
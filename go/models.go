@@ -6,21 +6,25 @@ import (
 )
 
 type Chair struct {
-	ID                     string    `db:"id"`
-	OwnerID                string    `db:"owner_id"`
-	Name                   string    `db:"name"`
-	Model                  string    `db:"model"`
-	IsActive               bool      `db:"is_active"`
-	AccessToken            string    `db:"access_token"`
-	TotalDistance          int       `db:"total_distance"`
-	CreatedAt              time.Time `db:"created_at"`
-	UpdatedAt              time.Time `db:"updated_at"`
-	TotalDistanceUpdatedAt time.Time `db:"total_distance_updated_at"`
+	ID                     string     `db:"id"`
+	OwnerID                string     `db:"owner_id"`
+	Name                   string     `db:"name"`
+	Model                  string     `db:"model"`
+	IsActive               bool       `db:"is_active"`
+	AccessToken            string     `db:"access_token"`
+	TotalDistance          int        `db:"total_distance"`
+	CreatedAt              time.Time  `db:"created_at"`
+	UpdatedAt              time.Time  `db:"updated_at"`
+	TotalDistanceUpdatedAt time.Time  `db:"total_distance_updated_at"`
+	RetiredAt              *time.Time `db:"retired_at"`
+	RegisterTokenID        *string    `db:"chair_register_token_id"`
+	OwnerDisabledAt        *time.Time `db:"owner_disabled_at"`
 }
 
 type ChairModel struct {
 	Name  string `db:"name"`
 	Speed int    `db:"speed"`
+	Tier  string `db:"tier"`
 }
 
 type ChairLocation struct {
@@ -44,8 +48,10 @@ type User struct {
 }
 
 type PaymentToken struct {
+	ID        string    `db:"id"`
 	UserID    string    `db:"user_id"`
 	Token     string    `db:"token"`
+	IsDefault bool      `db:"is_default"`
 	CreatedAt time.Time `db:"created_at"`
 }
 
@@ -60,6 +66,7 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	OwnerID              sql.NullString `db:"owner_id"`
 }
 
 type RideStatus struct {
@@ -71,6 +78,12 @@ type RideStatus struct {
 	ChairSentAt *time.Time `db:"chair_sent_at"`
 }
 
+type RideCancellation struct {
+	RideID    string    `db:"ride_id"`
+	Fee       int       `db:"fee"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
 type Owner struct {
 	ID                 string    `db:"id"`
 	Name               string    `db:"name"`
@@ -81,9 +94,12 @@ type Owner struct {
 }
 
 type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
-	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+	UserID     string     `db:"user_id"`
+	Code       string     `db:"code"`
+	Discount   int        `db:"discount"`
+	Definition string     `db:"definition"`
+	CreatedAt  time.Time  `db:"created_at"`
+	UsedBy     *string    `db:"used_by"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	ExpiredAt  *time.Time `db:"expired_at"`
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+)
+
+// RideEvent はライドのステータス変更を購読者へ通知するためのイベント
+type RideEvent struct {
+	// StatusID は挿入された ride_statuses の ID。椅子の割り当てのようにステータス行を伴わない場合は空
+	StatusID string
+	RideID   string
+	UserID   string
+	ChairID  string
+	Status   string
+}
+
+// NotificationHub はキー(ユーザーIDなど)ごとに購読者を管理するプロセス内のpub/sub
+type NotificationHub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan *RideEvent]struct{}
+	bufferSize  int
+}
+
+func NewNotificationHub(bufferSize int) *NotificationHub {
+	return &NotificationHub{
+		subscribers: map[string]map[chan *RideEvent]struct{}{},
+		bufferSize:  bufferSize,
+	}
+}
+
+// Subscribe はキーに対する購読を開始し、イベントを受け取るチャネルと購読解除関数を返す
+// 受信が追いつかずバッファが溢れた場合はチャネルが閉じられるので、購読者は接続を終了して再接続させる
+func (h *NotificationHub) Subscribe(key string) (<-chan *RideEvent, func()) {
+	ch := make(chan *RideEvent, h.bufferSize)
+
+	h.mutex.Lock()
+	subs, ok := h.subscribers[key]
+	if !ok {
+		subs = map[chan *RideEvent]struct{}{}
+		h.subscribers[key] = subs
+	}
+	subs[ch] = struct{}{}
+	h.mutex.Unlock()
+
+	return ch, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.remove(key, ch)
+	}
+}
+
+// Publish はキーの購読者全員にイベントを配信する。購読者を待つことはない
+func (h *NotificationHub) Publish(key string, event *RideEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for ch := range h.subscribers[key] {
+		select {
+		case ch <- event:
+		default:
+			// 順序を保証できなくなるので、溢れた購読者は切断する
+			h.remove(key, ch)
+		}
+	}
+}
+
+// SubscriberCount は現在の購読者の総数を返す
+func (h *NotificationHub) SubscriberCount() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	count := 0
+	for _, subs := range h.subscribers {
+		count += len(subs)
+	}
+	return count
+}
+
+// remove は購読者を削除してチャネルを閉じる。mutex を取得した状態で呼び出すこと
+func (h *NotificationHub) remove(key string, ch chan *RideEvent) {
+	subs, ok := h.subscribers[key]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subscribers, key)
+	}
+}
+
+// publishRideEvent はライドのステータス変更を関係する購読者へ通知する
+// トランザクションのコミット後に呼び出すこと
+func publishRideEvent(event *RideEvent) {
+	userNotificationHub.Publish(event.UserID, event)
+	if event.ChairID != "" {
+		chairNotificationHub.Publish(event.ChairID, event)
+	}
+}
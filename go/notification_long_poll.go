@@ -0,0 +1,74 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// notificationLongPollTimeout はロングポーリングで新しいステータスを待つ最大時間
+	notificationLongPollTimeout = 10 * time.Second
+
+	minNotificationRetryAfterMs = 30
+	maxNotificationRetryAfterMs = 1000
+)
+
+// wantsJSONNotification はクライアントがSSEではなくJSONのロングポーリングを要求しているかを返す
+// Accept の品質値(q)が SSE より高い場合に JSON を返す。同じ品質値なら先に書かれた方を優先し、決められなければ SSE にする
+func wantsJSONNotification(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	jsonQuality, jsonIndex := acceptQuality(accept, "application/json")
+	sseQuality, sseIndex := acceptQuality(accept, "text/event-stream")
+	if jsonQuality <= 0 {
+		return false
+	}
+	if jsonQuality != sseQuality {
+		return jsonQuality > sseQuality
+	}
+	return jsonIndex < sseIndex
+}
+
+// acceptQuality は Accept ヘッダーで mediaType に付けられた品質値と、それを決めたメディアレンジの位置を返す
+// 複数のメディアレンジが一致する場合は最も具体的なもの(type/subtype、type/*、*/* の順)を使う
+// 一致するメディアレンジが無ければ 0, -1 を返す
+func acceptQuality(accept, mediaType string) (float64, int) {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, index, specificity := 0.0, -1, 0
+	for i, v := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		s := 0
+		switch mediaRange {
+		case mediaType:
+			s = 3
+		case mainType + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		if qv, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qv, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		quality, index, specificity = q, i, s
+	}
+	return quality, index
+}
+
+// notificationRetryAfterMs は現在接続している通知の購読者数に応じて、次のリクエストまでの待ち時間を返す
+// 購読者が多いほど間隔を空けさせてサーバーの負荷を抑える
+func notificationRetryAfterMs() int {
+	subscribers := userNotificationHub.SubscriberCount() + chairNotificationHub.SubscriberCount()
+	return min(minNotificationRetryAfterMs+subscribers/4, maxNotificationRetryAfterMs)
+}
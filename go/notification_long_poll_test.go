@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsJSONNotification(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   bool
+	}{
+		{"no accept header", "", false},
+		{"json", "application/json", true},
+		{"json with charset", "application/json; charset=utf-8", true},
+		{"sse", "text/event-stream", false},
+		{"any", "*/*", false},
+		{"json refused", "application/json;q=0", false},
+		{"sse preferred by q", "text/event-stream, application/json;q=0.1", false},
+		{"json preferred by q", "text/event-stream;q=0.5, application/json;q=0.9", true},
+		{"json listed first", "application/json, text/event-stream", true},
+		{"sse listed first", "text/event-stream, application/json", false},
+		{"json by subtype wildcard", "application/*;q=0.5, text/event-stream;q=0.4", true},
+		{"exact range wins over wildcard", "application/json;q=0.2, */*;q=0.8", false},
+		{"json with browser defaults", "application/json, text/plain, */*", true},
+		{"invalid q is ignored", "application/json;q=abc, text/event-stream;q=0.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/app/notification", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if got := wantsJSONNotification(r); got != tt.want {
+				t.Fatalf("wantsJSONNotification(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 const (
 	initialFare     = 500
 	farePerDistance = 100
+	// 椅子が配車位置に向かい始めた後のキャンセル料
+	cancellationFee = 500
 )
 
 type ownerPostOwnersRequest struct {
@@ -42,15 +45,36 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	accessToken := secureRandomStr(32)
 	chairRegisterToken := secureRandomStr(32)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err))
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(
 		ctx,
 		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
 		ownerID, req.Name, accessToken, chairRegisterToken,
-	)
-	if err != nil {
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to insert owner: %w", err))
 		return
 	}
+	// 登録時に返すトークンは default の登録トークンとして、期限や上限なしで使える
+	if err := insertChairRegisterToken(ctx, tx, &ChairRegisterToken{
+		ID:      ulid.Make().String(),
+		OwnerID: ownerID,
+		Name:    defaultChairRegisterTokenName,
+		Token:   chairRegisterToken,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to commit: %w", err))
+		return
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
@@ -104,8 +128,8 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 
 	owner := ctx.Value("owner").(*Owner)
 
-	chairs := []Chair{}
-	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	chairs, err := selectSalesChairs(ctx, owner.ID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get chairs: %w", err))
 		return
 	}
@@ -120,31 +144,53 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		Sales   int    `db:"sales"`
 	}
 
-	rideSalesData := []rideSales{}
-	query := `
-		SELECT rides.chair_id,
-		       SUM(?) + SUM(ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude) * ?) AS sales
-		FROM rides
-		JOIN ride_statuses ON rides.id = ride_statuses.ride_id
-		WHERE rides.chair_id IN (?) AND ride_statuses.status = 'COMPLETED' AND ride_statuses.updated_at BETWEEN ? AND ?
-		GROUP BY rides.chair_id
-	`
-	query, args, err := sqlx.In(query, initialFare, farePerDistance, chairIDs, since, until)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create query: %w", err))
-		return
-	}
-	query = db.Rebind(query)
-
-	if err := db.SelectContext(ctx, &rideSalesData, query, args...); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride sales: %w", err))
-		return
-	}
-
 	// 売上データをマッピング
 	chairSalesMap := make(map[string]int)
-	for _, data := range rideSalesData {
-		chairSalesMap[data.ChairID] = data.Sales
+	if len(chairIDs) > 0 {
+		// 完了時に確定した運賃の内訳を使い、内訳が無いライドは標準の運賃で計算する
+		rideSalesData := []rideSales{}
+		query := `
+			SELECT rides.chair_id,
+			       SUM(COALESCE(ride_fares.final_fare, ? + (ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude)) * ?)) AS sales
+			FROM rides
+			JOIN ride_statuses ON rides.id = ride_statuses.ride_id
+			LEFT JOIN ride_fares ON ride_fares.ride_id = rides.id
+			WHERE rides.owner_id = ? AND rides.chair_id IN (?) AND ride_statuses.status = 'COMPLETED' AND ride_statuses.created_at BETWEEN ? AND ?
+			GROUP BY rides.chair_id
+		`
+		query, args, err := sqlx.In(query, initialFare, farePerDistance, owner.ID, chairIDs, since, until)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create query: %w", err))
+			return
+		}
+		if err := db.SelectContext(ctx, &rideSalesData, db.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get ride sales: %w", err))
+			return
+		}
+		for _, data := range rideSalesData {
+			chairSalesMap[data.ChairID] = data.Sales
+		}
+
+		// 期間内に返金した額を差し引く (refunds.amount は負の値)
+		refundData := []rideSales{}
+		query, args, err = sqlx.In(`
+			SELECT rides.chair_id, SUM(refunds.amount) AS sales
+			FROM refunds
+			JOIN rides ON rides.id = refunds.ride_id
+			WHERE rides.owner_id = ? AND rides.chair_id IN (?) AND refunds.status = ? AND refunds.created_at BETWEEN ? AND ?
+			GROUP BY rides.chair_id
+		`, owner.ID, chairIDs, RefundStatusSucceeded, since, until)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create query: %w", err))
+			return
+		}
+		if err := db.SelectContext(ctx, &refundData, db.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get refunds: %w", err))
+			return
+		}
+		for _, data := range refundData {
+			chairSalesMap[data.ChairID] += data.Sales
+		}
 	}
 
 	// レスポンス構造体を作成
@@ -178,6 +224,19 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, res)
 }
 
+// selectSalesChairs はオーナーが持っている椅子と、譲渡する前にオーナーの売上を計上した椅子を返す
+func selectSalesChairs(ctx context.Context, ownerID string) ([]Chair, error) {
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, `
+		SELECT * FROM chairs
+		WHERE owner_id = ? OR id IN (SELECT chair_id FROM rides WHERE owner_id = ?)
+		ORDER BY created_at, id
+	`, ownerID, ownerID); err != nil {
+		return nil, err
+	}
+	return chairs, nil
+}
+
 func sumSales(rides []Ride) int {
 	sale := 0
 	for _, ride := range rides {
@@ -215,6 +274,8 @@ type ownerGetChairResponseChair struct {
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
+	OwnerDisabledAt        *int64 `json:"owner_disabled_at,omitempty"`
 }
 
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
@@ -245,6 +306,18 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		var retiredAt *int64
+		if c.RetiredAt != nil {
+			t := c.RetiredAt.UnixMilli()
+			retiredAt = &t
+		}
+
+		var ownerDisabledAt *int64
+		if c.OwnerDisabledAt != nil {
+			t := c.OwnerDisabledAt.UnixMilli()
+			ownerDisabledAt = &t
+		}
+
 		res.Chairs = append(res.Chairs, ownerGetChairResponseChair{
 			ID:                     c.ID,
 			Name:                   c.Name,
@@ -253,8 +326,219 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 			RegisteredAt:           c.CreatedAt.UnixMilli(),
 			TotalDistance:          totalDistance,
 			TotalDistanceUpdatedAt: updatedAt,
+			RetiredAt:              retiredAt,
+			OwnerDisabledAt:        ownerDisabledAt,
 		})
 	}
 
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerPatchChairRequest struct {
+	Name string `json:"name"`
+}
+
+type ownerPostChairTransferRequest struct {
+	OwnerID string `json:"owner_id"`
+}
+
+type ownerChairResponse struct {
+	ID              string `json:"id"`
+	OwnerID         string `json:"owner_id"`
+	Name            string `json:"name"`
+	Model           string `json:"model"`
+	Active          bool   `json:"active"`
+	OwnerDisabledAt *int64 `json:"owner_disabled_at,omitempty"`
+}
+
+func newOwnerChairResponse(c *Chair) *ownerChairResponse {
+	res := &ownerChairResponse{
+		ID:      c.ID,
+		OwnerID: c.OwnerID,
+		Name:    c.Name,
+		Model:   c.Model,
+		Active:  c.IsActive,
+	}
+	if c.OwnerDisabledAt != nil {
+		t := c.OwnerDisabledAt.UnixMilli()
+		res.OwnerDisabledAt = &t
+	}
+	return res
+}
+
+// writeOwnerChairError は椅子の管理操作のエラーを対応するステータスコードで返す
+func writeOwnerChairError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errChairNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errTransferOwnerNotFound):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errChairRetired), errors.Is(err, errChairHasOngoingRide):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// ownerPatchChair はオーナーが椅子の名前を変更する
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name) are empty"))
+		return
+	}
+
+	chair, err := chairRepo.RenameChair(ctx, owner.ID, chairID, req.Name)
+	if err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStateIndex.SetName(chair.ID, chair.Name)
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+// ownerPostChairDeactivate はオーナーが椅子の配車受付を停止させる
+// ownerPostChairEnable で解除するまで、椅子は自分で受付を再開できない
+func ownerPostChairDeactivate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := chairRepo.DeactivateChair(ctx, owner.ID, chairID)
+	if err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStateIndex.SetActive(chair.ID, false)
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+// ownerPostChairEnable はオーナーによる配車受付の停止を解除する
+// 受付は再開せず、椅子が自分で再開できるようになるだけ
+func ownerPostChairEnable(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := chairRepo.EnableChair(ctx, owner.ID, chairID)
+	if err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+// ownerPostChairRetire はオーナーが椅子を引退させる
+// 以降は割り当てられず、椅子のアクセストークンも使えなくなる
+func ownerPostChairRetire(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	chair, err := chairRepo.RetireChair(ctx, owner.ID, chairID)
+	if err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStateIndex.RemoveChair(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownerPostChairTransfer はオーナーが椅子を別のオーナーに移す
+// 未完了のライドがある椅子は移せない(409)
+func ownerPostChairTransfer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostChairTransferRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.OwnerID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(owner_id) are empty"))
+		return
+	}
+	if req.OwnerID == owner.ID {
+		writeError(w, http.StatusBadRequest, errors.New("chair already belongs to the owner"))
+		return
+	}
+
+	chair, err := chairRepo.TransferChair(ctx, owner.ID, chairID, req.OwnerID)
+	if err != nil {
+		writeOwnerChairError(w, err)
+		return
+	}
+	chairStateIndex.SetOwner(chair.ID, chair.OwnerID)
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+type ownerPostRideRefundRequest struct {
+	Amount         int    `json:"amount"`
+	Reason         string `json:"reason"`
+	CouponDiscount int    `json:"coupon_discount"`
+}
+
+// ownerPostRideRefund はオーナーの椅子が担当したライドの決済を返金する
+func ownerPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("amount must be positive"))
+		return
+	}
+	if req.CouponDiscount < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("coupon_discount must not be negative"))
+		return
+	}
+
+	// 返金できるのは売上を計上したオーナーだけ。完了していないライドは返金できない
+	var rideOwnerID sql.NullString
+	if err := db.GetContext(ctx, &rideOwnerID, `SELECT owner_id FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !rideOwnerID.Valid || rideOwnerID.String != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	refund, err := refundRide(ctx, paymentGateway, &RefundRequest{
+		RideID:         rideID,
+		Amount:         req.Amount,
+		Reason:         req.Reason,
+		RequestedBy:    owner.ID,
+		CouponDiscount: req.CouponDiscount,
+	})
+	if err != nil {
+		writeRefundError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, refund)
+}
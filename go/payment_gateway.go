@@ -6,92 +6,164 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"time"
 )
 
-var erroredUpstream = errors.New("errored upstream")
+var (
+	// erroredUpstream は決済マイクロサービスの障害などで結果が確定しなかった(再送すべき)ことを表す
+	erroredUpstream = errors.New("errored upstream")
+	// errPaymentRejected は決済マイクロサービスが決済を拒否した(再送しても結果が変わらない)ことを表す
+	errPaymentRejected = errors.New("payment rejected")
+)
+
+// writePaymentError は決済マイクロサービスに関わるエラーを対応するステータスコードで返す
+// サーキットブレーカーが開いている場合は、リクエストを送らなかったことが分かるよう 503 にする
+func writePaymentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPaymentRejected):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errCircuitOpen):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, erroredUpstream):
+		writeError(w, http.StatusBadGateway, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
 
 type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
 
-type paymentGatewayGetPaymentsResponseOne struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+// PaymentGatewayConfig は PaymentGatewayClient の設定
+type PaymentGatewayConfig struct {
+	// ConnectTimeout は接続を確立するまでのタイムアウト
+	ConnectTimeout time.Duration
+	// ReadTimeout はリクエストを送ってからレスポンスヘッダーを受け取るまでのタイムアウト
+	ReadTimeout time.Duration
+	// FailureThreshold 回連続して失敗したらサーキットブレーカーを開く
+	FailureThreshold int
+	// OpenTimeout はサーキットブレーカーを開いてから再び試行するまでの時間
+	OpenTimeout time.Duration
+}
+
+// PaymentGatewayClient は決済マイクロサービスのクライアント
+// 決済マイクロサービスが落ちているときにリクエストを送り続けないよう、サーキットブレーカーを持つ
+type PaymentGatewayClient struct {
+	httpClient *http.Client
+	breaker    *circuitBreaker
+}
+
+func NewPaymentGatewayClient(config PaymentGatewayConfig) *PaymentGatewayClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = config.ReadTimeout
+
+	return &PaymentGatewayClient{
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   config.ConnectTimeout + config.ReadTimeout,
+		},
+		breaker: newCircuitBreaker(config.FailureThreshold, config.OpenTimeout),
+	}
+}
+
+// BreakerState はサーキットブレーカーの状態を返す
+func (c *PaymentGatewayClient) BreakerState() CircuitBreakerState {
+	return c.breaker.State()
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+// PostPayment は決済を1回要求する
+// 同じ idempotencyKey での再送は決済マイクロサービス側で重複排除されるので、再送は呼び出し側(PaymentWorker)が同じキーで行う
+// サーキットブレーカーが開いている場合はリクエストを送らずに errCircuitOpen を返す
+func (c *PaymentGatewayClient) PostPayment(ctx context.Context, paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
 	b, err := json.Marshal(param)
 	if err != nil {
 		return err
 	}
 
-	// 失敗したらとりあえずリトライ
-	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
-	retry := 0
-	for {
-		err := func() error {
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token)
-
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusNoContent {
-				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
-				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
-				if err != nil {
-					return err
-				}
-				getReq.Header.Set("Authorization", "Bearer "+token)
-
-				getRes, err := http.DefaultClient.Do(getReq)
-				if err != nil {
-					return err
-				}
-				defer res.Body.Close()
-
-				// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
-				if getRes.StatusCode != http.StatusOK {
-					return fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
-				}
-				var payments []paymentGatewayGetPaymentsResponseOne
-				if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
-					return err
-				}
-
-				rides, err := retrieveRidesOrderByCreatedAtAsc()
-				if err != nil {
-					return err
-				}
-
-				if len(rides) != len(payments) {
-					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
-				}
-
-				return nil
-			}
-			return nil
-		}()
-		if err != nil {
-			if retry < 5 {
-				retry++
-				time.Sleep(100 * time.Millisecond)
-				continue
-			} else {
-				return err
-			}
-		}
-		break
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	if err := c.breaker.Allow(); err != nil {
+		return err
+	}
+
+	err = c.do(req)
+	// 決済の拒否は決済マイクロサービスが正常に応答した結果なので、失敗として数えない
+	c.breaker.Record(err == nil || errors.Is(err, errPaymentRejected))
+	return err
+}
+
+func (c *PaymentGatewayClient) do(req *http.Request) error {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", erroredUpstream, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if isRetryablePaymentStatus(res.StatusCode) {
+		return fmt.Errorf("%w: [%s %s] unexpected status code (%d): %s", erroredUpstream, req.Method, req.URL.Path, res.StatusCode, body)
+	}
+	return fmt.Errorf("%w: [%s %s] status code (%d): %s", errPaymentRejected, req.Method, req.URL.Path, res.StatusCode, body)
+}
+
+// isRetryablePaymentStatus は同じ冪等キーで再送すれば結果が変わりうるステータスコードかどうかを返す
+// 409 は同じキーの決済が処理中、429 は流量制限、5xx は決済マイクロサービスの障害を表す
+// それ以外の4xx (不正な決済トークンや決済額、期限切れのキーなど) は再送しても結果が変わらない
+func isRetryablePaymentStatus(statusCode int) bool {
+	switch {
+	case statusCode == http.StatusConflict, statusCode == http.StatusTooManyRequests:
+		return true
+	case statusCode >= 500:
+		return true
+	default:
+		return false
+	}
+}
+
+type paymentGatewayPostRefundRequest struct {
+	// PaymentIdempotencyKey は返金する決済を要求したときの冪等キー
+	PaymentIdempotencyKey string `json:"payment_idempotency_key"`
+	Amount                int    `json:"amount"`
+}
+
+// PostRefund は決済の返金を1回要求する
+// 決済と同様に、同じ idempotencyKey での再送は決済マイクロサービス側で重複排除される
+func (c *PaymentGatewayClient) PostRefund(ctx context.Context, paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error {
+	b, err := json.Marshal(param)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/refunds", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+
+	if err := c.breaker.Allow(); err != nil {
+		return err
 	}
 
-	return nil
+	err = c.do(req)
+	c.breaker.Record(err == nil || errors.Is(err, errPaymentRejected))
+	return err
 }
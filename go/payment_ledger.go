@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// PaymentStatusPending は決済を要求中
+	PaymentStatusPending = "pending"
+	// PaymentStatusSucceeded は決済が完了した
+	PaymentStatusSucceeded = "succeeded"
+	// PaymentStatusFailed は決済が拒否された
+	PaymentStatusFailed = "failed"
+	// PaymentStatusUnknown は応答が得られず、決済されたか分からない
+	PaymentStatusUnknown = "unknown"
+)
+
+// Payment はライドごとの決済の記録
+type Payment struct {
+	RideID         string    `db:"ride_id"`
+	UserID         string    `db:"user_id"`
+	Amount         int       `db:"amount"`
+	IdempotencyKey string    `db:"idempotency_key"`
+	PaymentTokenID *string   `db:"payment_token_id"`
+	Status         string    `db:"status"`
+	LastError      *string   `db:"last_error"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+// chargeRide はライドの料金を決済し、結果を payments テーブルに記録する
+// tokens は試す順に並べた決済手段で、決済が拒否されたら次の決済手段で決済し直す
+// 既に決済済みのライドは再度決済しない。結果が分からなかったライドは同じ決済手段と冪等キーで再送して照合する
+func chargeRide(ctx context.Context, client *PaymentGatewayClient, paymentGatewayURL string, tokens []PaymentToken, ride *Ride, amount int) error {
+	if len(tokens) == 0 {
+		return fmt.Errorf("%w: payment token not registered", errPaymentRejected)
+	}
+
+	payment, err := preparePayment(ctx, ride, amount)
+	if err != nil {
+		return err
+	}
+	if payment.Status == PaymentStatusSucceeded {
+		return nil
+	}
+	if payment.PaymentTokenID != nil {
+		tokens = preferPaymentToken(tokens, *payment.PaymentTokenID)
+	}
+
+	var paymentErr error
+	for i, token := range tokens {
+		if i > 0 {
+			// 拒否された試行とは別の決済として新しい冪等キーで送る
+			if payment, err = preparePayment(ctx, ride, amount); err != nil {
+				return errors.Join(paymentErr, err)
+			}
+		}
+
+		paymentErr = attemptPayment(ctx, client, paymentGatewayURL, &token, payment)
+		if !errors.Is(paymentErr, errPaymentRejected) {
+			return paymentErr
+		}
+	}
+	return paymentErr
+}
+
+// preferPaymentToken は id の決済手段を先頭に移した一覧を返す
+func preferPaymentToken(tokens []PaymentToken, id string) []PaymentToken {
+	sorted := make([]PaymentToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.ID == id {
+			sorted = append(sorted, t)
+		}
+	}
+	for _, t := range tokens {
+		if t.ID != id {
+			sorted = append(sorted, t)
+		}
+	}
+	return sorted
+}
+
+// attemptPayment は1つの決済手段で決済を要求し、結果と使った決済手段を記録する
+func attemptPayment(ctx context.Context, client *PaymentGatewayClient, paymentGatewayURL string, token *PaymentToken, payment *Payment) error {
+	paymentErr := client.PostPayment(ctx, paymentGatewayURL, token.Token, payment.IdempotencyKey, &paymentGatewayPostPaymentRequest{
+		Amount: payment.Amount,
+	})
+
+	status := PaymentStatusSucceeded
+	var lastError *string
+	if paymentErr != nil {
+		switch {
+		case errors.Is(paymentErr, errPaymentRejected):
+			status = PaymentStatusFailed
+		case errors.Is(paymentErr, errCircuitOpen):
+			// リクエストを送っていないので、まだ決済されていない
+			status = PaymentStatusPending
+		default:
+			status = PaymentStatusUnknown
+		}
+		msg := paymentErr.Error()
+		lastError = &msg
+	}
+	// リクエストがキャンセルされても結果は記録する
+	if _, err := db.ExecContext(context.WithoutCancel(ctx), `UPDATE payments SET status = ?, payment_token_id = ?, last_error = ? WHERE ride_id = ?`,
+		status, token.ID, lastError, payment.RideID); err != nil {
+		return errors.Join(paymentErr, fmt.Errorf("failed to record payment: %w", err))
+	}
+	payment.Status = status
+	payment.PaymentTokenID = &token.ID
+
+	return paymentErr
+}
+
+// preparePayment は決済を要求する前の記録を作る
+// 以前の試行が拒否された場合だけ新しい冪等キーを発行する。結果が分からない試行は二重決済を避けるため同じキーと金額で再送する
+func preparePayment(ctx context.Context, ride *Ride, amount int) (*Payment, error) {
+	payment := &Payment{}
+	err := db.GetContext(ctx, payment, `SELECT * FROM payments WHERE ride_id = ?`, ride.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		payment = &Payment{
+			RideID:         ride.ID,
+			UserID:         ride.UserID,
+			Amount:         amount,
+			IdempotencyKey: ulid.Make().String(),
+			Status:         PaymentStatusPending,
+		}
+		if _, err := db.ExecContext(ctx, `INSERT INTO payments (ride_id, user_id, amount, idempotency_key, status) VALUES (?, ?, ?, ?, ?)`,
+			payment.RideID, payment.UserID, payment.Amount, payment.IdempotencyKey, payment.Status); err != nil {
+			return nil, fmt.Errorf("failed to insert payment: %w", err)
+		}
+		return payment, nil
+	}
+
+	if payment.Status == PaymentStatusSucceeded {
+		return payment, nil
+	}
+	if payment.Status == PaymentStatusFailed {
+		payment.IdempotencyKey = ulid.Make().String()
+		payment.Amount = amount
+	}
+	payment.Status = PaymentStatusPending
+	if _, err := db.ExecContext(ctx, `UPDATE payments SET amount = ?, idempotency_key = ?, status = ?, last_error = NULL WHERE ride_id = ?`,
+		payment.Amount, payment.IdempotencyKey, payment.Status, payment.RideID); err != nil {
+		return nil, fmt.Errorf("failed to update payment: %w", err)
+	}
+	return payment, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// PaymentJobStatusQueued は配信待ち(再送待ちを含む)
+	PaymentJobStatusQueued = "queued"
+	// PaymentJobStatusProcessing はワーカーが配信中
+	PaymentJobStatusProcessing = "processing"
+	// PaymentJobStatusSucceeded は配信が完了した
+	PaymentJobStatusSucceeded = "succeeded"
+	// PaymentJobStatusDead は再送を諦めた。手動で再投入するまで配信しない
+	PaymentJobStatusDead = "dead"
+)
+
+// PaymentJob は決済マイクロサービスへ配信する決済要求
+// ライドの状態と同じトランザクションで書き込み、ワーカーが非同期に配信する
+type PaymentJob struct {
+	ID            string    `db:"id" json:"id"`
+	RideID        string    `db:"ride_id" json:"ride_id"`
+	UserID        string    `db:"user_id" json:"user_id"`
+	Amount        int       `db:"amount" json:"amount"`
+	Status        string    `db:"status" json:"status"`
+	Attempts      int       `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     *string   `db:"last_error" json:"last_error"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// enqueuePayment はライドの決済要求をアウトボックスに書き込む
+// 呼び出し側のトランザクションがコミットされた後に PaymentWorker.Notify を呼ぶこと
+func enqueuePayment(ctx context.Context, tx *sqlx.Tx, ride *Ride, amount int) error {
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO payment_jobs (id, ride_id, user_id, amount, status, next_attempt_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP(6))`,
+		ulid.Make().String(), ride.ID, ride.UserID, amount, PaymentJobStatusQueued,
+	); err != nil {
+		return fmt.Errorf("failed to enqueue payment: %w", err)
+	}
+	return nil
+}
+
+// PaymentWorker はアウトボックスの決済要求を決済マイクロサービスへ配信する
+// 決済マイクロサービスに負荷をかけすぎないよう、同時に配信する数を concurrency までに制限する
+// 失敗した要求は指数バックオフ(ジッター付き)で再送し、maxAttempts 回失敗するか決済が拒否されたら dead にする
+type PaymentWorker struct {
+	db           *sqlx.DB
+	client       *PaymentGatewayClient
+	concurrency  int
+	pollInterval time.Duration
+	maxAttempts  int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+
+	slots  chan struct{}
+	wakeup chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewPaymentWorker(db *sqlx.DB, client *PaymentGatewayClient, concurrency int) (*PaymentWorker, error) {
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("invalid payment worker concurrency: %d", concurrency)
+	}
+	return &PaymentWorker{
+		db:           db,
+		client:       client,
+		concurrency:  concurrency,
+		pollInterval: 500 * time.Millisecond,
+		maxAttempts:  10,
+		baseBackoff:  100 * time.Millisecond,
+		maxBackoff:   30 * time.Second,
+		slots:        make(chan struct{}, concurrency),
+		wakeup:       make(chan struct{}, 1),
+	}, nil
+}
+
+// Notify は新しい決済要求が書き込まれたことをワーカーに知らせる
+func (p *PaymentWorker) Notify() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Start はバックグラウンドで配信ループを開始する
+func (p *PaymentWorker) Start(ctx context.Context) {
+	// 前回のプロセスが配信中のまま終了した要求は配信し直す
+	if _, err := p.db.ExecContext(ctx, `UPDATE payment_jobs SET status = ? WHERE status = ?`, PaymentJobStatusQueued, PaymentJobStatusProcessing); err != nil {
+		slog.Error("failed to requeue processing payment jobs", "error", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := p.dispatch(ctx); err != nil {
+				slog.Error("failed to dispatch payment jobs", "error", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-p.wakeup:
+			case <-ctx.Done():
+				p.wg.Wait()
+				return
+			}
+		}
+	}()
+}
+
+// dispatch は空いている枠の数だけ配信可能な要求を取り出し、並行して配信する
+func (p *PaymentWorker) dispatch(ctx context.Context) error {
+	free := p.concurrency - len(p.slots)
+	if free <= 0 {
+		return nil
+	}
+
+	jobs, err := p.claim(ctx, free)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		p.slots <- struct{}{}
+		p.wg.Add(1)
+		go func() {
+			defer func() {
+				<-p.slots
+				p.wg.Done()
+				// 枠が空いたので次の要求を取りに行く
+				p.Notify()
+			}()
+			p.deliver(ctx, job)
+		}()
+	}
+	return nil
+}
+
+// claim は配信時刻を過ぎた要求を最大 limit 件取り出して processing にする
+func (p *PaymentWorker) claim(ctx context.Context, limit int) ([]*PaymentJob, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	jobs := []*PaymentJob{}
+	if err := tx.SelectContext(ctx, &jobs, `
+		SELECT * FROM payment_jobs
+		WHERE status = ? AND next_attempt_at <= CURRENT_TIMESTAMP(6)
+		ORDER BY next_attempt_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	`, PaymentJobStatusQueued, limit); err != nil {
+		return nil, fmt.Errorf("failed to select payment jobs: %w", err)
+	}
+	if len(jobs) == 0 {
+		return jobs, nil
+	}
+
+	ids := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.ID)
+	}
+	query, args, err := sqlx.In(`UPDATE payment_jobs SET status = ? WHERE id IN (?)`, PaymentJobStatusProcessing, ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("failed to claim payment jobs: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// deliver は1件の要求を配信し、結果に応じて要求の状態を更新する
+func (p *PaymentWorker) deliver(ctx context.Context, job *PaymentJob) {
+	deliverErr := p.charge(ctx, job)
+
+	var err error
+	switch {
+	case deliverErr == nil:
+		_, err = p.db.ExecContext(ctx, `UPDATE payment_jobs SET status = ?, attempts = attempts + 1, last_error = NULL WHERE id = ?`,
+			PaymentJobStatusSucceeded, job.ID)
+	case errors.Is(deliverErr, errCircuitOpen):
+		// 決済マイクロサービスへは送っていないので、試行回数には数えずに後で配信し直す
+		_, err = p.db.ExecContext(ctx, `UPDATE payment_jobs SET status = ?, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+			PaymentJobStatusQueued, deliverErr.Error(), time.Now().Add(p.backoff(job.Attempts+1)), job.ID)
+	case errors.Is(deliverErr, errPaymentRejected) || job.Attempts+1 >= p.maxAttempts:
+		slog.Error("payment job is dead", "job_id", job.ID, "ride_id", job.RideID, "error", deliverErr)
+		_, err = p.db.ExecContext(ctx, `UPDATE payment_jobs SET status = ?, attempts = attempts + 1, last_error = ? WHERE id = ?`,
+			PaymentJobStatusDead, deliverErr.Error(), job.ID)
+	default:
+		_, err = p.db.ExecContext(ctx, `UPDATE payment_jobs SET status = ?, attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+			PaymentJobStatusQueued, deliverErr.Error(), time.Now().Add(p.backoff(job.Attempts+1)), job.ID)
+	}
+	if err != nil {
+		slog.Error("failed to update payment job", "job_id", job.ID, "error", err)
+	}
+}
+
+func (p *PaymentWorker) charge(ctx context.Context, job *PaymentJob) error {
+	tokens, err := selectPaymentTokens(ctx, p.db, job.UserID)
+	if err != nil {
+		return err
+	}
+
+	var paymentGatewayURL string
+	if err := p.db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+
+	return chargeRide(ctx, p.client, paymentGatewayURL, tokens, &Ride{ID: job.RideID, UserID: job.UserID}, job.Amount)
+}
+
+// backoff は attempts 回目の失敗の後に待つ時間を返す
+func (p *PaymentWorker) backoff(attempts int) time.Duration {
+	return jitteredBackoff(p.baseBackoff, p.maxBackoff, attempts)
+}
+
+// jitteredBackoff は base から倍々に増やし maxBackoff で打ち止めにした、attempts 回目の失敗の後に待つ時間を返す
+// 待ち時間の半分を乱数にして、同時に失敗した要求の再送が重ならないようにする
+func jitteredBackoff(base, maxBackoff time.Duration, attempts int) time.Duration {
+	d := maxBackoff
+	if shift := attempts - 1; shift < 32 {
+		if e := base << shift; e > 0 && e < maxBackoff {
+			d = e
+		}
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Jobs は指定した状態の要求を新しい順に返す
+func (p *PaymentWorker) Jobs(ctx context.Context, status string, limit int) ([]*PaymentJob, error) {
+	jobs := []*PaymentJob{}
+	if err := p.db.SelectContext(ctx, &jobs, `SELECT * FROM payment_jobs WHERE status = ? ORDER BY created_at DESC LIMIT ?`, status, limit); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Redrive は dead になった要求を再び配信待ちに戻す
+// 戻した場合は true、要求が存在しないか dead でない場合は false を返す
+func (p *PaymentWorker) Redrive(ctx context.Context, jobID string) (bool, error) {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE payment_jobs SET status = ?, attempts = 0, next_attempt_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND status = ?`,
+		PaymentJobStatusQueued, jobID, PaymentJobStatusDead)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		p.Notify()
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// defaultPricingTier はティアを指定しなかったライドに適用する料金ティア
+	defaultPricingTier = "standard"
+	// pricingSurgeAreaSize はサージ倍率を求めるエリアの幅(緯度・経度の整数座標単位)
+	pricingSurgeAreaSize = 100
+	// defaultSurgeMaxMultiplier は settings に pricing_surge_max_multiplier が無い場合のサージ倍率の上限
+	defaultSurgeMaxMultiplier = 2.0
+	// priceQuoteTTL は見積もりをライドの作成に使える期間
+	priceQuoteTTL = 5 * time.Minute
+)
+
+var (
+	errUnknownPricingTier = errors.New("unknown pricing tier")
+	errPriceQuoteNotFound = errors.New("price quote not found")
+	errPriceQuoteExpired  = errors.New("price quote expired")
+	errPriceQuoteUsed     = errors.New("price quote already used")
+	errPriceQuoteMismatch = errors.New("price quote does not match the ride")
+)
+
+// PricingTier は料金ティアごとの運賃
+type PricingTier struct {
+	Name            string `db:"name"`
+	BaseFare        int    `db:"base_fare"`
+	FarePerDistance int    `db:"fare_per_distance"`
+}
+
+// PriceQuote はライドの運賃の見積もり。ライドの作成時にこの運賃で確定する
+type PriceQuote struct {
+	ID                   string    `db:"id"`
+	UserID               string    `db:"user_id"`
+	Tier                 *string   `db:"tier"`
+	PickupLatitude       int       `db:"pickup_latitude"`
+	PickupLongitude      int       `db:"pickup_longitude"`
+	DestinationLatitude  int       `db:"destination_latitude"`
+	DestinationLongitude int       `db:"destination_longitude"`
+	BaseFare             int       `db:"base_fare"`
+	FarePerDistance      int       `db:"fare_per_distance"`
+	SurgeMultiplier      float64   `db:"surge_multiplier"`
+	MeteredFare          int       `db:"metered_fare"`
+	Fare                 int       `db:"fare"`
+	RideID               *string   `db:"ride_id"`
+	ExpiresAt            time.Time `db:"expires_at"`
+	CreatedAt            time.Time `db:"created_at"`
+}
+
+// Pricer はライドの運賃を見積もる
+// 距離あたりの運賃には、配車位置のエリアで待っているライドと空いている椅子の比に応じたサージ倍率をかける
+type Pricer struct {
+	db    *sqlx.DB
+	index *ChairStateIndex
+}
+
+func NewPricer(db *sqlx.DB, index *ChairStateIndex) (*Pricer, error) {
+	return &Pricer{db: db, index: index}, nil
+}
+
+// Quote は見積もりを作成して保存する。tier が nil の場合は defaultPricingTier の運賃でどの椅子でも配車できる
+func (p *Pricer) Quote(ctx context.Context, tx *sqlx.Tx, userID string, tier *string, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (*PriceQuote, error) {
+	tierName := defaultPricingTier
+	if tier != nil {
+		tierName = *tier
+	}
+	pricing := &PricingTier{}
+	if err := tx.GetContext(ctx, pricing, `SELECT * FROM pricing_tiers WHERE name = ?`, tierName); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", errUnknownPricingTier, tierName)
+		}
+		return nil, fmt.Errorf("failed to select pricing tier: %w", err)
+	}
+
+	surge, err := p.surgeMultiplier(ctx, tx, pickupLatitude, pickupLongitude)
+	if err != nil {
+		return nil, err
+	}
+
+	distance := calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	meteredFare := int(math.Round(float64(pricing.FarePerDistance*distance) * surge))
+	now := time.Now()
+	quote := &PriceQuote{
+		ID:                   ulid.Make().String(),
+		UserID:               userID,
+		Tier:                 tier,
+		PickupLatitude:       pickupLatitude,
+		PickupLongitude:      pickupLongitude,
+		DestinationLatitude:  destLatitude,
+		DestinationLongitude: destLongitude,
+		BaseFare:             pricing.BaseFare,
+		FarePerDistance:      pricing.FarePerDistance,
+		SurgeMultiplier:      surge,
+		MeteredFare:          meteredFare,
+		Fare:                 pricing.BaseFare + meteredFare,
+		ExpiresAt:            now.Add(priceQuoteTTL),
+		CreatedAt:            now,
+	}
+	if _, err := tx.NamedExecContext(ctx, `
+		INSERT INTO price_quotes (id, user_id, tier, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, base_fare, fare_per_distance, surge_multiplier, metered_fare, fare, expires_at, created_at)
+		VALUES (:id, :user_id, :tier, :pickup_latitude, :pickup_longitude, :destination_latitude, :destination_longitude, :base_fare, :fare_per_distance, :surge_multiplier, :metered_fare, :fare, :expires_at, :created_at)
+	`, quote); err != nil {
+		return nil, fmt.Errorf("failed to insert price quote: %w", err)
+	}
+	return quote, nil
+}
+
+// surgeMultiplier は配車位置を含むエリアのサージ倍率を返す
+// 待っているライドが空いている椅子より多いほど高くなり、settings の pricing_surge_max_multiplier を上限とする
+func (p *Pricer) surgeMultiplier(ctx context.Context, tx *sqlx.Tx, latitude, longitude int) (float64, error) {
+	maxMultiplier := defaultSurgeMaxMultiplier
+	var value string
+	if err := tx.GetContext(ctx, &value, `SELECT value FROM settings WHERE name = 'pricing_surge_max_multiplier'`); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("failed to select surge setting: %w", err)
+		}
+	} else {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid pricing_surge_max_multiplier: %w", err)
+		}
+		maxMultiplier = v
+	}
+	if maxMultiplier <= 1 {
+		return 1, nil
+	}
+
+	minLatitude := floorDiv(latitude, pricingSurgeAreaSize) * pricingSurgeAreaSize
+	minLongitude := floorDiv(longitude, pricingSurgeAreaSize) * pricingSurgeAreaSize
+	maxLatitude := minLatitude + pricingSurgeAreaSize - 1
+	maxLongitude := minLongitude + pricingSurgeAreaSize - 1
+
+	var waiting int
+	if err := tx.GetContext(ctx, &waiting, `
+		SELECT COUNT(*) FROM rides
+		WHERE chair_id IS NULL
+		AND pickup_latitude BETWEEN ? AND ? AND pickup_longitude BETWEEN ? AND ?
+		AND NOT EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status = 'CANCELED')
+	`, minLatitude, maxLatitude, minLongitude, maxLongitude); err != nil {
+		return 0, fmt.Errorf("failed to count waiting rides: %w", err)
+	}
+	if waiting == 0 {
+		return 1, nil
+	}
+
+	free := p.index.CountFreeChairsInArea(minLatitude, minLongitude, maxLatitude, maxLongitude)
+	if free == 0 {
+		return maxMultiplier, nil
+	}
+
+	// 0.1 刻みに丸めて、見積もりごとに細かく変わらないようにする
+	surge := math.Round(float64(waiting)/float64(free)*10) / 10
+	return min(max(surge, 1), maxMultiplier), nil
+}
+
+// Lock は見積もりをライドに紐づけて運賃を確定する
+func (p *Pricer) Lock(ctx context.Context, tx *sqlx.Tx, quoteID, userID, rideID string, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (*PriceQuote, error) {
+	quote := &PriceQuote{}
+	if err := tx.GetContext(ctx, quote, `SELECT * FROM price_quotes WHERE id = ? AND user_id = ? FOR UPDATE`, quoteID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errPriceQuoteNotFound
+		}
+		return nil, fmt.Errorf("failed to select price quote: %w", err)
+	}
+	if quote.RideID != nil {
+		return nil, errPriceQuoteUsed
+	}
+	if !time.Now().Before(quote.ExpiresAt) {
+		return nil, errPriceQuoteExpired
+	}
+	if quote.PickupLatitude != pickupLatitude || quote.PickupLongitude != pickupLongitude ||
+		quote.DestinationLatitude != destLatitude || quote.DestinationLongitude != destLongitude {
+		return nil, errPriceQuoteMismatch
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE price_quotes SET ride_id = ? WHERE id = ?`, rideID, quote.ID); err != nil {
+		return nil, fmt.Errorf("failed to lock price quote: %w", err)
+	}
+	quote.RideID = &rideID
+	return quote, nil
+}
+
+// selectRideQuote はライドで確定した見積もりを返す。見積もり導入前のライドの場合は標準の運賃で作った見積もりを返す
+func selectRideQuote(ctx context.Context, q sqlx.QueryerContext, ride *Ride) (*PriceQuote, error) {
+	quote := &PriceQuote{}
+	if err := sqlx.GetContext(ctx, q, quote, `SELECT * FROM price_quotes WHERE ride_id = ?`, ride.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return standardQuote(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), nil
+		}
+		return nil, fmt.Errorf("failed to select price quote: %w", err)
+	}
+	return quote, nil
+}
+
+// standardQuote はサージ倍率をかけない標準の運賃の見積もりを返す。保存はしない
+func standardQuote(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) *PriceQuote {
+	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	return &PriceQuote{
+		PickupLatitude:       pickupLatitude,
+		PickupLongitude:      pickupLongitude,
+		DestinationLatitude:  destLatitude,
+		DestinationLongitude: destLongitude,
+		BaseFare:             initialFare,
+		FarePerDistance:      farePerDistance,
+		SurgeMultiplier:      1,
+		MeteredFare:          meteredFare,
+		Fare:                 initialFare + meteredFare,
+	}
+}
+
+// writePriceQuoteError は見積もりのエラーを対応するステータスコードで返す
+func writePriceQuoteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownPricingTier), errors.Is(err, errPriceQuoteMismatch):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errPriceQuoteNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errPriceQuoteExpired), errors.Is(err, errPriceQuoteUsed):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
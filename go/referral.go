@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// ReferralRewardOnSignup は招待されたユーザーの登録時に招待した側へ特典を付与する
+	ReferralRewardOnSignup = "signup"
+	// ReferralRewardOnFirstRide は招待されたユーザーの初めてのライドの完了時に招待した側へ特典を付与する
+	ReferralRewardOnFirstRide = "first_ride"
+)
+
+// errInvitationCodeUnavailable は存在しない、または上限まで使われた招待コードを使おうとしたときのエラー
+var errInvitationCodeUnavailable = errors.New("この招待コードは使用できません。")
+
+// ReferralConfig は招待プログラムの設定。settings テーブルの referral_* で変更できる
+type ReferralConfig struct {
+	// MaxInvites は1つの招待コードを使える人数
+	MaxInvites int `json:"max_invites"`
+	// InviteeReward は招待されたユーザーに付与するクーポンの割引額
+	InviteeReward int `json:"invitee_reward"`
+	// InviterReward は招待したユーザーに付与するクーポンの割引額
+	InviterReward int `json:"inviter_reward"`
+	// RewardOn は招待したユーザーに特典を付与するタイミング
+	RewardOn string `json:"reward_on"`
+}
+
+var defaultReferralConfig = ReferralConfig{
+	MaxInvites:    3,
+	InviteeReward: 1500,
+	InviterReward: 1000,
+	RewardOn:      ReferralRewardOnSignup,
+}
+
+// Invitation は招待コードを使った登録の記録
+type Invitation struct {
+	InviteeID      string     `db:"invitee_id"`
+	InviterID      string     `db:"inviter_id"`
+	InvitationCode string     `db:"invitation_code"`
+	RewardAmount   *int       `db:"reward_amount"`
+	RewardCode     *string    `db:"reward_code"`
+	RewardedAt     *time.Time `db:"rewarded_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+// loadReferralConfig は settings テーブルから招待プログラムの設定を読み込む
+// 設定が無い項目は defaultReferralConfig の値を使う
+func loadReferralConfig(ctx context.Context, q sqlx.QueryerContext) (*ReferralConfig, error) {
+	type setting struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}
+	settings := []setting{}
+	if err := sqlx.SelectContext(ctx, q, &settings, `SELECT name, value FROM settings WHERE name LIKE 'referral\_%'`); err != nil {
+		return nil, fmt.Errorf("failed to select referral settings: %w", err)
+	}
+
+	config := defaultReferralConfig
+	for _, s := range settings {
+		var target *int
+		switch s.Name {
+		case "referral_max_invites":
+			target = &config.MaxInvites
+		case "referral_invitee_reward":
+			target = &config.InviteeReward
+		case "referral_inviter_reward":
+			target = &config.InviterReward
+		case "referral_reward_on":
+			if s.Value != ReferralRewardOnSignup && s.Value != ReferralRewardOnFirstRide {
+				return nil, fmt.Errorf("invalid referral_reward_on: %s", s.Value)
+			}
+			config.RewardOn = s.Value
+			continue
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(s.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", s.Name, err)
+		}
+		*target = n
+	}
+	return &config, nil
+}
+
+// acceptInvitation は招待コードを使った登録を記録し、設定に従って特典を付与する
+func acceptInvitation(ctx context.Context, tx *sqlx.Tx, inviteeID, invitationCode string) error {
+	config, err := loadReferralConfig(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	// 同じ招待コードへの並行した登録で上限を超えないように、招待した側の行をロックする
+	var inviter User
+	if err := tx.GetContext(ctx, &inviter, `SELECT * FROM users WHERE invitation_code = ? FOR UPDATE`, invitationCode); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errInvitationCodeUnavailable
+		}
+		return fmt.Errorf("failed to select user: %w", err)
+	}
+
+	var invites int
+	if err := tx.GetContext(ctx, &invites, `SELECT COUNT(*) FROM invitations WHERE inviter_id = ?`, inviter.ID); err != nil {
+		return fmt.Errorf("failed to count invitations: %w", err)
+	}
+	if invites >= config.MaxInvites {
+		return errInvitationCodeUnavailable
+	}
+
+	invitation := &Invitation{
+		InviteeID:      inviteeID,
+		InviterID:      inviter.ID,
+		InvitationCode: invitationCode,
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO invitations (invitee_id, inviter_id, invitation_code) VALUES (?, ?, ?)`,
+		invitation.InviteeID, invitation.InviterID, invitation.InvitationCode,
+	); err != nil {
+		return fmt.Errorf("failed to insert invitation: %w", err)
+	}
+
+	// 招待クーポン付与
+	if config.InviteeReward > 0 {
+		if err := issueCoupon(ctx, tx, inviteeID, "INV_"+invitationCode, config.InviteeReward, couponDefinitionInvited); err != nil {
+			return err
+		}
+	}
+
+	if config.RewardOn == ReferralRewardOnSignup {
+		return rewardInviter(ctx, tx, config, invitation)
+	}
+	return nil
+}
+
+// rewardReferralOnFirstRide は招待されたユーザーのライドが完了したときに、未付与の特典を招待した側へ付与する
+func rewardReferralOnFirstRide(ctx context.Context, tx *sqlx.Tx, inviteeID string) error {
+	config, err := loadReferralConfig(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if config.RewardOn != ReferralRewardOnFirstRide {
+		return nil
+	}
+
+	invitation := &Invitation{}
+	if err := tx.GetContext(ctx, invitation, `SELECT * FROM invitations WHERE invitee_id = ? AND rewarded_at IS NULL FOR UPDATE`, inviteeID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("failed to select invitation: %w", err)
+	}
+	return rewardInviter(ctx, tx, config, invitation)
+}
+
+// rewardInviter は招待したユーザーに特典のクーポンを付与し、招待の記録に反映する
+func rewardInviter(ctx context.Context, tx *sqlx.Tx, config *ReferralConfig, invitation *Invitation) error {
+	var code *string
+	if config.InviterReward > 0 {
+		c := fmt.Sprintf("RWD_%s_%s", invitation.InvitationCode, invitation.InviteeID)
+		if err := issueCoupon(ctx, tx, invitation.InviterID, c, config.InviterReward, couponDefinitionInviter); err != nil {
+			return err
+		}
+		code = &c
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE invitations SET reward_amount = ?, reward_code = ?, rewarded_at = NOW(6) WHERE invitee_id = ?`,
+		config.InviterReward, code, invitation.InviteeID,
+	); err != nil {
+		return fmt.Errorf("failed to update invitation: %w", err)
+	}
+	return nil
+}
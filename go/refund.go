@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+	// RefundStatusUnknown は返金されたか分からないまま再送を諦めた。返金額は確保したまま、運営が再送するまで残す
+	RefundStatusUnknown = "unknown"
+
+	// refundRequestedByOperator は運営が要求した返金の requested_by
+	refundRequestedByOperator = "operator"
+
+	// refundAttemptLease は返金を要求している間、RefundReconciler が同じ返金を再送しないよう空ける時間
+	// 決済マイクロサービスのタイムアウトより十分長くする
+	refundAttemptLease = 1 * time.Minute
+)
+
+var (
+	// errRefundNotAllowed は返金できない状態のライドに返金を要求したことを表す
+	errRefundNotAllowed = errors.New("refund not allowed")
+	// errRefundExceedsPayment は決済額を超える返金を要求したことを表す
+	errRefundExceedsPayment = errors.New("refund exceeds payment")
+)
+
+// Refund はライドの決済に対する返金の記録
+// 決済台帳に対する負の記録で、Amount は負の値で持つ
+type Refund struct {
+	ID             string    `db:"id" json:"id"`
+	RideID         string    `db:"ride_id" json:"ride_id"`
+	Amount         int       `db:"amount" json:"amount"`
+	Reason         string    `db:"reason" json:"reason"`
+	RequestedBy    string    `db:"requested_by" json:"requested_by"`
+	IdempotencyKey string    `db:"idempotency_key" json:"-"`
+	Status         string    `db:"status" json:"status"`
+	CouponCode     *string   `db:"coupon_code" json:"coupon_code"`
+	CouponDiscount int       `db:"coupon_discount" json:"-"`
+	Attempts       int       `db:"attempts" json:"-"`
+	NextAttemptAt  time.Time `db:"next_attempt_at" json:"-"`
+	LastError      *string   `db:"last_error" json:"-"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// RefundRequest は返金の要求
+type RefundRequest struct {
+	RideID string
+	// Amount は返金額(正の値)
+	Amount int
+	Reason string
+	// RequestedBy は返金を要求したオーナーのID、運営の場合は refundRequestedByOperator
+	RequestedBy string
+	// CouponDiscount が正の値なら、その割引額のクーポンをライドの利用者に付与し直す
+	CouponDiscount int
+}
+
+// refundRide はライドの決済を返金する
+// 返金額を確保するために先に pending の記録を書き込み、決済マイクロサービスの結果で succeeded か failed にする
+// 返金されたか分からなかった場合は pending のまま残し、RefundReconciler が同じ冪等キーで再送する
+func refundRide(ctx context.Context, client *PaymentGatewayClient, req *RefundRequest) (*Refund, error) {
+	refund, payment, err := reserveRefund(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	refundErr := sendRefund(ctx, client, refund, payment)
+	ctx = context.WithoutCancel(ctx)
+	if refundErr != nil {
+		if errors.Is(refundErr, erroredUpstream) {
+			if err := retryRefundLater(ctx, refund, refundErr, 1, jitteredBackoff(refundReconcilerBaseBackoff, refundReconcilerMaxBackoff, 1)); err != nil {
+				return nil, errors.Join(refundErr, err)
+			}
+			return nil, refundErr
+		}
+		if err := failRefund(ctx, refund, refundErr); err != nil {
+			return nil, errors.Join(refundErr, err)
+		}
+		return nil, refundErr
+	}
+
+	return completeRefund(ctx, refund, payment)
+}
+
+// sendRefund は決済マイクロサービスに返金を要求する。再送する場合も refund.IdempotencyKey を使う
+func sendRefund(ctx context.Context, client *PaymentGatewayClient, refund *Refund, payment *Payment) error {
+	if payment.PaymentTokenID == nil {
+		return fmt.Errorf("%w: payment method of the ride is unknown", errRefundNotAllowed)
+	}
+	token := &PaymentToken{}
+	if err := db.GetContext(ctx, token, `SELECT * FROM payment_tokens WHERE id = ?`, *payment.PaymentTokenID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: payment method of the ride was deleted", errRefundNotAllowed)
+		}
+		return err
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+
+	return client.PostRefund(ctx, paymentGatewayURL, token.Token, refund.IdempotencyKey, &paymentGatewayPostRefundRequest{
+		PaymentIdempotencyKey: payment.IdempotencyKey,
+		Amount:                -refund.Amount,
+	})
+}
+
+// retryRefundLater は返金を pending のまま残し、attempts 回目の要求の後 backoff だけ空けて再送させる
+func retryRefundLater(ctx context.Context, refund *Refund, refundErr error, attempts int, backoff time.Duration) error {
+	if _, err := db.ExecContext(ctx, `UPDATE refunds SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ? AND status = ?`,
+		attempts, refundErr.Error(), time.Now().Add(backoff), refund.ID, RefundStatusPending); err != nil {
+		return fmt.Errorf("failed to update refund: %w", err)
+	}
+	return nil
+}
+
+// failRefund は返金を failed にし、確保していた返金額を解放する
+// 返金されていないことが確かな場合にだけ使い、結果が分からない場合は giveUpRefund を使う
+func failRefund(ctx context.Context, refund *Refund, refundErr error) error {
+	if _, err := db.ExecContext(ctx, `UPDATE refunds SET status = ?, last_error = ? WHERE id = ? AND status = ?`,
+		RefundStatusFailed, refundErr.Error(), refund.ID, RefundStatusPending); err != nil {
+		return fmt.Errorf("failed to update refund: %w", err)
+	}
+	return nil
+}
+
+// completeRefund は返金を succeeded にし、クーポンの付与と売上からの差し引きを行う
+// 既に完了していた場合は何もせずに現在の記録を返す
+func completeRefund(ctx context.Context, refund *Refund, payment *Payment) (*Refund, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE refunds SET status = ?, last_error = NULL WHERE id = ? AND status = ?`, RefundStatusSucceeded, refund.ID, RefundStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if count == 0 {
+		if err := tx.GetContext(ctx, refund, `SELECT * FROM refunds WHERE id = ?`, refund.ID); err != nil {
+			return nil, err
+		}
+		return refund, nil
+	}
+
+	if refund.CouponDiscount > 0 {
+		code := "RF_" + refund.ID
+		if err := issueCoupon(ctx, tx, payment.UserID, code, refund.CouponDiscount, couponDefinitionRefund); err != nil {
+			return nil, fmt.Errorf("failed to issue coupon: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE refunds SET coupon_code = ? WHERE id = ?`, code, refund.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.GetContext(ctx, refund, `SELECT * FROM refunds WHERE id = ?`, refund.ID); err != nil {
+		return nil, err
+	}
+
+	// 返金額は返金した時点の売上から差し引く
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, refund.RideID); err != nil {
+		return nil, err
+	}
+	if ride.ChairID.Valid && ride.OwnerID.Valid {
+		if err := recordChairSales(ctx, tx, ride.OwnerID.String, ride.ChairID.String, refund.CreatedAt, refund.Amount, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// reserveRefund は返金額が決済額を超えないことを確認し、pending の返金を記録する
+func reserveRefund(ctx context.Context, req *RefundRequest) (*Refund, *Payment, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	payment := &Payment{}
+	if err := tx.GetContext(ctx, payment, `SELECT * FROM payments WHERE ride_id = ? FOR UPDATE`, req.RideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("%w: ride has not been charged", errRefundNotAllowed)
+		}
+		return nil, nil, err
+	}
+	if payment.Status != PaymentStatusSucceeded {
+		return nil, nil, fmt.Errorf("%w: payment is %s", errRefundNotAllowed, payment.Status)
+	}
+
+	// 失敗した返金以外は返金済み(処理中や結果が分からないものを含む)として数える
+	var refunded int
+	if err := tx.GetContext(ctx, &refunded, `SELECT COALESCE(-SUM(amount), 0) FROM refunds WHERE ride_id = ? AND status != ?`, req.RideID, RefundStatusFailed); err != nil {
+		return nil, nil, err
+	}
+	if refunded+req.Amount > payment.Amount {
+		return nil, nil, fmt.Errorf("%w: %d has already been refunded out of %d", errRefundExceedsPayment, refunded, payment.Amount)
+	}
+
+	refund := &Refund{
+		ID:             ulid.Make().String(),
+		RideID:         req.RideID,
+		Amount:         -req.Amount,
+		Reason:         req.Reason,
+		RequestedBy:    req.RequestedBy,
+		IdempotencyKey: ulid.Make().String(),
+		Status:         RefundStatusPending,
+		CouponDiscount: req.CouponDiscount,
+		// 要求している間は RefundReconciler に再送させない
+		NextAttemptAt: time.Now().Add(refundAttemptLease),
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO refunds (id, ride_id, amount, reason, requested_by, idempotency_key, status, coupon_discount, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		refund.ID, refund.RideID, refund.Amount, refund.Reason, refund.RequestedBy, refund.IdempotencyKey, refund.Status, refund.CouponDiscount, refund.NextAttemptAt,
+	); err != nil {
+		return nil, nil, fmt.Errorf("failed to insert refund: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return refund, payment, nil
+}
+
+// writeRefundError は返金のエラーを対応するステータスコードで返す
+func writeRefundError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRefundNotAllowed), errors.Is(err, errRefundExceedsPayment):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writePaymentError(w, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// refundReconcilerBatchSize は1回の処理で再送する返金の数
+	refundReconcilerBatchSize = 16
+	// refundReconcilerMaxAttempts 回要求しても結果が分からなければ unknown にする
+	refundReconcilerMaxAttempts = 10
+	refundReconcilerBaseBackoff = 1 * time.Second
+	refundReconcilerMaxBackoff  = 5 * time.Minute
+)
+
+// RefundReconciler は返金されたか分からず pending のまま残った返金を、同じ冪等キーで再送して succeeded か failed にする
+// 決済マイクロサービスは冪等キーが同じ要求を二重に処理しないので、再送しても二重に返金されない
+// 再送しても結果が分からない返金は unknown にし、運営が Redrive するまで返金額を確保したまま残す
+type RefundReconciler struct {
+	db       *sqlx.DB
+	client   *PaymentGatewayClient
+	interval time.Duration
+}
+
+func NewRefundReconciler(db *sqlx.DB, client *PaymentGatewayClient, interval time.Duration) (*RefundReconciler, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid refund reconcile interval: %s", interval)
+	}
+	return &RefundReconciler{db: db, client: client, interval: interval}, nil
+}
+
+// Start はバックグラウンドで再送を開始する
+func (r *RefundReconciler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.RunOnce(ctx); err != nil {
+					slog.Error("failed to reconcile refunds", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RunOnce は再送時刻を過ぎた pending の返金を再送する
+func (r *RefundReconciler) RunOnce(ctx context.Context) error {
+	refunds, err := r.claim(ctx)
+	if err != nil {
+		return err
+	}
+	for _, refund := range refunds {
+		if err := r.reconcile(ctx, refund); err != nil {
+			slog.Error("failed to reconcile refund", "refund_id", refund.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// claim は再送時刻を過ぎた返金を取り出し、再送している間は他から取り出されないよう再送時刻を先に延ばす
+func (r *RefundReconciler) claim(ctx context.Context) ([]*Refund, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	refunds := []*Refund{}
+	if err := tx.SelectContext(ctx, &refunds, `
+		SELECT * FROM refunds
+		WHERE status = ? AND next_attempt_at <= CURRENT_TIMESTAMP(6)
+		ORDER BY next_attempt_at
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	`, RefundStatusPending, refundReconcilerBatchSize); err != nil {
+		return nil, fmt.Errorf("failed to select pending refunds: %w", err)
+	}
+	if len(refunds) == 0 {
+		return refunds, nil
+	}
+
+	ids := make([]string, 0, len(refunds))
+	for _, refund := range refunds {
+		ids = append(ids, refund.ID)
+	}
+	query, args, err := sqlx.In(`UPDATE refunds SET next_attempt_at = ? WHERE id IN (?)`, time.Now().Add(refundAttemptLease), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("failed to claim pending refunds: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// reconcile は1件の返金を再送し、結果に応じて返金の状態を更新する
+func (r *RefundReconciler) reconcile(ctx context.Context, refund *Refund) error {
+	payment := &Payment{}
+	if err := r.db.GetContext(ctx, payment, `SELECT * FROM payments WHERE ride_id = ?`, refund.RideID); err != nil {
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	refundErr := sendRefund(ctx, r.client, refund, payment)
+	attempts := refund.Attempts + 1
+	switch {
+	case refundErr == nil:
+		if _, err := completeRefund(ctx, refund, payment); err != nil {
+			return err
+		}
+		slog.Info("reconciled refund", "refund_id", refund.ID, "attempts", attempts)
+		return nil
+	case errors.Is(refundErr, errCircuitOpen):
+		// 決済マイクロサービスへは送っていないので、試行回数には数えずに後で再送する
+		return retryRefundLater(ctx, refund, refundErr, refund.Attempts, jitteredBackoff(refundReconcilerBaseBackoff, refundReconcilerMaxBackoff, attempts))
+	case errors.Is(refundErr, erroredUpstream) && attempts < refundReconcilerMaxAttempts:
+		return retryRefundLater(ctx, refund, refundErr, attempts, jitteredBackoff(refundReconcilerBaseBackoff, refundReconcilerMaxBackoff, attempts))
+	case errors.Is(refundErr, erroredUpstream):
+		// 返金されている可能性があるので、返金額を解放せずに運営の対応を待つ
+		slog.Error("refund result is unknown", "refund_id", refund.ID, "ride_id", refund.RideID, "attempts", attempts, "error", refundErr)
+		return giveUpRefund(ctx, refund, refundErr, attempts)
+	default:
+		slog.Error("refund failed", "refund_id", refund.ID, "ride_id", refund.RideID, "attempts", attempts, "error", refundErr)
+		return failRefund(ctx, refund, refundErr)
+	}
+}
+
+// giveUpRefund は結果が分からない返金を unknown にする。確保していた返金額は解放しない
+func giveUpRefund(ctx context.Context, refund *Refund, refundErr error, attempts int) error {
+	if _, err := db.ExecContext(ctx, `UPDATE refunds SET status = ?, attempts = ?, last_error = ? WHERE id = ? AND status = ?`,
+		RefundStatusUnknown, attempts, refundErr.Error(), refund.ID, RefundStatusPending); err != nil {
+		return fmt.Errorf("failed to update refund: %w", err)
+	}
+	return nil
+}
+
+// Refunds は指定した状態の返金を新しい順に返す
+func (r *RefundReconciler) Refunds(ctx context.Context, status string, limit int) ([]*Refund, error) {
+	refunds := []*Refund{}
+	if err := r.db.SelectContext(ctx, &refunds, `SELECT * FROM refunds WHERE status = ? ORDER BY created_at DESC LIMIT ?`, status, limit); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// Redrive は unknown になった返金を pending に戻し、同じ冪等キーで再送させる
+// 戻した場合は true、返金が存在しないか unknown でない場合は false を返す
+func (r *RefundReconciler) Redrive(ctx context.Context, refundID string) (bool, error) {
+	result, err := r.db.ExecContext(ctx,
+		`UPDATE refunds SET status = ?, attempts = 0, next_attempt_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND status = ?`,
+		RefundStatusPending, refundID, RefundStatusUnknown)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fareCurrency は運賃の通貨
+const fareCurrency = "JPY"
+
+// RideFare はライドの運賃の内訳
+// ライドの作成時に保存し、完了またはキャンセル時に確定させる
+type RideFare struct {
+	RideID string `db:"ride_id"`
+	// BaseFare は初乗り運賃
+	BaseFare int `db:"base_fare"`
+	// MeteredFare は距離に応じた運賃(サージ適用後)
+	MeteredFare     int     `db:"metered_fare"`
+	SurgeMultiplier float64 `db:"surge_multiplier"`
+	CouponCode      *string `db:"coupon_code"`
+	CouponDiscount  int     `db:"coupon_discount"`
+	// FinalFare は利用者が支払う運賃
+	FinalFare   int        `db:"final_fare"`
+	Currency    string     `db:"currency"`
+	FinalizedAt *time.Time `db:"finalized_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+}
+
+// calculateRideFare は確定した見積もりと適用済みのクーポンから運賃の内訳を計算する
+func calculateRideFare(ctx context.Context, q sqlx.QueryerContext, ride *Ride) (*RideFare, error) {
+	quote, err := selectRideQuote(ctx, q, ride)
+	if err != nil {
+		return nil, err
+	}
+	coupon, discount, err := appliedCoupon(ctx, q, ride, quote.Fare, quote.MeteredFare)
+	if err != nil {
+		return nil, err
+	}
+
+	fare := &RideFare{
+		RideID:          ride.ID,
+		BaseFare:        quote.BaseFare,
+		MeteredFare:     quote.MeteredFare,
+		SurgeMultiplier: quote.SurgeMultiplier,
+		CouponDiscount:  discount,
+		FinalFare:       quote.BaseFare + max(quote.MeteredFare-discount, 0),
+		Currency:        fareCurrency,
+	}
+	if coupon != nil {
+		fare.CouponCode = &coupon.Code
+	}
+	return fare, nil
+}
+
+// saveRideFare は運賃の内訳を計算して保存する。finalize が true なら確定させる
+func saveRideFare(ctx context.Context, tx *sqlx.Tx, ride *Ride, finalize bool) (*RideFare, error) {
+	fare, err := calculateRideFare(ctx, tx, ride)
+	if err != nil {
+		return nil, err
+	}
+	if finalize {
+		now := time.Now()
+		fare.FinalizedAt = &now
+	}
+
+	if _, err := tx.NamedExecContext(ctx, `
+		INSERT INTO ride_fares (ride_id, base_fare, metered_fare, surge_multiplier, coupon_code, coupon_discount, final_fare, currency, finalized_at)
+		VALUES (:ride_id, :base_fare, :metered_fare, :surge_multiplier, :coupon_code, :coupon_discount, :final_fare, :currency, :finalized_at)
+		ON DUPLICATE KEY UPDATE
+			base_fare = VALUES(base_fare), metered_fare = VALUES(metered_fare), surge_multiplier = VALUES(surge_multiplier),
+			coupon_code = VALUES(coupon_code), coupon_discount = VALUES(coupon_discount), final_fare = VALUES(final_fare),
+			finalized_at = VALUES(finalized_at)
+	`, fare); err != nil {
+		return nil, fmt.Errorf("failed to save ride fare: %w", err)
+	}
+	return fare, nil
+}
+
+// finalizeCanceledRideFare はキャンセルしたライドの運賃をキャンセル料で確定させる
+func finalizeCanceledRideFare(ctx context.Context, tx *sqlx.Tx, rideID string, fee int) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE ride_fares SET coupon_code = NULL, coupon_discount = 0, final_fare = ?, finalized_at = NOW(6) WHERE ride_id = ?`,
+		fee, rideID,
+	); err != nil {
+		return fmt.Errorf("failed to finalize ride fare: %w", err)
+	}
+	return nil
+}
+
+// selectRideFare は保存された運賃の内訳を返す。保存されていない場合はその場で計算する
+func selectRideFare(ctx context.Context, q sqlx.QueryerContext, ride *Ride) (*RideFare, error) {
+	fare := &RideFare{}
+	if err := sqlx.GetContext(ctx, q, fare, `SELECT * FROM ride_fares WHERE ride_id = ?`, ride.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return calculateRideFare(ctx, q, ride)
+		}
+		return nil, fmt.Errorf("failed to select ride fare: %w", err)
+	}
+	return fare, nil
+}
+
+// selectRideFares は複数のライドの運賃の内訳をまとめて返す
+func selectRideFares(ctx context.Context, q sqlx.QueryerContext, rides []Ride) (map[string]*RideFare, error) {
+	fares := make(map[string]*RideFare, len(rides))
+	if len(rides) == 0 {
+		return fares, nil
+	}
+
+	rideIDs := make([]string, len(rides))
+	for i, ride := range rides {
+		rideIDs[i] = ride.ID
+	}
+	query, args, err := sqlx.In(`SELECT * FROM ride_fares WHERE ride_id IN (?)`, rideIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create query: %w", err)
+	}
+	stored := []*RideFare{}
+	if err := sqlx.SelectContext(ctx, q, &stored, db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("failed to select ride fares: %w", err)
+	}
+	for _, f := range stored {
+		fares[f.RideID] = f
+	}
+
+	for i := range rides {
+		if _, ok := fares[rides[i].ID]; ok {
+			continue
+		}
+		f, err := calculateRideFare(ctx, q, &rides[i])
+		if err != nil {
+			return nil, err
+		}
+		fares[rides[i].ID] = f
+	}
+	return fares, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	RideStatusMatching  = "MATCHING"
+	RideStatusEnroute   = "ENROUTE"
+	RideStatusPickup    = "PICKUP"
+	RideStatusCarrying  = "CARRYING"
+	RideStatusArrived   = "ARRIVED"
+	RideStatusCompleted = "COMPLETED"
+	RideStatusCanceled  = "CANCELED"
+)
+
+// ErrUnknownRideStatus は存在しないステータスへの遷移を要求されたときのエラー
+var ErrUnknownRideStatus = errors.New("unknown ride status")
+
+// RideTransitionError は現在のステータスから許可されていない遷移を要求されたときのエラー
+type RideTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *RideTransitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("ride cannot start with status %s", e.To)
+	}
+	return fmt.Sprintf("ride cannot transition from %s to %s", e.From, e.To)
+}
+
+// RideTransition は実行したステータス遷移
+type RideTransition struct {
+	// StatusID は挿入された ride_statuses の ID
+	StatusID string
+	From     string
+	To       string
+}
+
+// RideStateMachine はライドのステータス遷移の規則を管理する
+// ride_statuses への挿入は全てこの型を経由させ、規則を1か所にまとめる
+type RideStateMachine struct {
+	// transitions[from] は from から遷移できるステータスの集合。"" はライド作成時を表す
+	transitions map[string]map[string]struct{}
+}
+
+func NewRideStateMachine() *RideStateMachine {
+	m := &RideStateMachine{transitions: map[string]map[string]struct{}{}}
+	m.allow("", RideStatusMatching)
+	m.allow(RideStatusMatching, RideStatusEnroute, RideStatusCanceled,
+		// 椅子が辞退した場合は再びマッチング待ちになる
+		RideStatusMatching)
+	m.allow(RideStatusEnroute, RideStatusPickup, RideStatusCanceled, RideStatusMatching)
+	m.allow(RideStatusPickup, RideStatusCarrying, RideStatusCanceled)
+	m.allow(RideStatusCarrying, RideStatusArrived)
+	m.allow(RideStatusArrived, RideStatusCompleted)
+	m.allow(RideStatusCompleted)
+	m.allow(RideStatusCanceled)
+	return m
+}
+
+func (m *RideStateMachine) allow(from string, to ...string) {
+	next, ok := m.transitions[from]
+	if !ok {
+		next = map[string]struct{}{}
+		m.transitions[from] = next
+	}
+	for _, t := range to {
+		next[t] = struct{}{}
+	}
+}
+
+// IsTerminal はそれ以上遷移しないステータスかどうかを返す
+func (m *RideStateMachine) IsTerminal(status string) bool {
+	next, ok := m.transitions[status]
+	return ok && len(next) == 0
+}
+
+// Validate は from から to への遷移が許可されているかを検証する
+func (m *RideStateMachine) Validate(from, to string) error {
+	if _, ok := m.transitions[to]; !ok || to == "" {
+		return fmt.Errorf("%w: %s", ErrUnknownRideStatus, to)
+	}
+	if _, ok := m.transitions[from][to]; !ok {
+		return &RideTransitionError{From: from, To: to}
+	}
+	return nil
+}
+
+// Current はライドの最新ステータスを返す。ステータスが1つも無い場合は "" を返す
+func (m *RideStateMachine) Current(ctx context.Context, tx executableGet, rideID string) (string, error) {
+	status := ""
+	if err := tx.GetContext(ctx, &status, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC, id DESC LIMIT 1`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return status, nil
+}
+
+// Transition は遷移を検証してからステータスを挿入する
+// 同じライドへの並行した遷移を防ぐため、呼び出し側で rides の行をロックしておくこと
+func (m *RideStateMachine) Transition(ctx context.Context, tx *sqlx.Tx, rideID, to string) (*RideTransition, error) {
+	from, err := m.Current(ctx, tx, rideID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest ride status: %w", err)
+	}
+	if err := m.Validate(from, to); err != nil {
+		return nil, err
+	}
+
+	statusID := ulid.Make().String()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`, statusID, rideID, to); err != nil {
+		return nil, fmt.Errorf("failed to insert ride status: %w", err)
+	}
+	return &RideTransition{StatusID: statusID, From: from, To: to}, nil
+}
+
+// writeRideTransitionError は遷移のエラーを対応するステータスコードで返す
+func writeRideTransitionError(w http.ResponseWriter, err error) {
+	var transitionErr *RideTransitionError
+	switch {
+	case errors.Is(err, ErrUnknownRideStatus):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.As(err, &transitionErr):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
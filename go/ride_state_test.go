@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var allRideStatuses = []string{
+	RideStatusMatching,
+	RideStatusEnroute,
+	RideStatusPickup,
+	RideStatusCarrying,
+	RideStatusArrived,
+	RideStatusCompleted,
+	RideStatusCanceled,
+}
+
+func TestRideStateMachineLegalTransitions(t *testing.T) {
+	legal := []struct {
+		from string
+		to   string
+	}{
+		{"", RideStatusMatching},
+		{RideStatusMatching, RideStatusEnroute},
+		{RideStatusMatching, RideStatusCanceled},
+		{RideStatusMatching, RideStatusMatching},
+		{RideStatusEnroute, RideStatusPickup},
+		{RideStatusEnroute, RideStatusCanceled},
+		{RideStatusEnroute, RideStatusMatching},
+		{RideStatusPickup, RideStatusCarrying},
+		{RideStatusPickup, RideStatusCanceled},
+		{RideStatusCarrying, RideStatusArrived},
+		{RideStatusArrived, RideStatusCompleted},
+	}
+
+	m := NewRideStateMachine()
+	allowed := map[string]bool{}
+	for _, tt := range legal {
+		allowed[tt.from+">"+tt.to] = true
+		t.Run(fmt.Sprintf("%q to %s", tt.from, tt.to), func(t *testing.T) {
+			if err := m.Validate(tt.from, tt.to); err != nil {
+				t.Fatalf("Validate(%q, %q) = %v, want nil", tt.from, tt.to, err)
+			}
+		})
+	}
+
+	// 上に挙げた以外の遷移は全て RideTransitionError になる
+	for _, from := range append([]string{""}, allRideStatuses...) {
+		for _, to := range allRideStatuses {
+			if allowed[from+">"+to] {
+				continue
+			}
+			t.Run(fmt.Sprintf("%q to %s is illegal", from, to), func(t *testing.T) {
+				err := m.Validate(from, to)
+				var transitionErr *RideTransitionError
+				if !errors.As(err, &transitionErr) {
+					t.Fatalf("Validate(%q, %q) = %v, want *RideTransitionError", from, to, err)
+				}
+				if transitionErr.From != from || transitionErr.To != to {
+					t.Fatalf("RideTransitionError = %+v, want From=%q To=%q", transitionErr, from, to)
+				}
+			})
+		}
+	}
+}
+
+func TestRideStateMachineIllegalTransitions(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"ENROUTE from CARRYING", RideStatusCarrying, RideStatusEnroute},
+		{"cancel while carrying", RideStatusCarrying, RideStatusCanceled},
+		{"skip PICKUP", RideStatusEnroute, RideStatusCarrying},
+		{"leave COMPLETED", RideStatusCompleted, RideStatusMatching},
+		{"complete twice", RideStatusCompleted, RideStatusCompleted},
+		{"leave CANCELED", RideStatusCanceled, RideStatusMatching},
+		{"cancel twice", RideStatusCanceled, RideStatusCanceled},
+		{"start with ENROUTE", "", RideStatusEnroute},
+		{"from unknown status", "FLYING", RideStatusMatching},
+	}
+
+	m := NewRideStateMachine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.Validate(tt.from, tt.to)
+			var transitionErr *RideTransitionError
+			if !errors.As(err, &transitionErr) {
+				t.Fatalf("Validate(%q, %q) = %v, want *RideTransitionError", tt.from, tt.to, err)
+			}
+			if errors.Is(err, ErrUnknownRideStatus) {
+				t.Fatalf("Validate(%q, %q) = %v, want not ErrUnknownRideStatus", tt.from, tt.to, err)
+			}
+		})
+	}
+}
+
+func TestRideStateMachineUnknownStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"unknown target", RideStatusMatching, "FLYING"},
+		{"empty target", RideStatusMatching, ""},
+		{"lower case target", RideStatusMatching, "enroute"},
+		{"unknown target from terminal status", RideStatusCompleted, "FLYING"},
+	}
+
+	m := NewRideStateMachine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.Validate(tt.from, tt.to); !errors.Is(err, ErrUnknownRideStatus) {
+				t.Fatalf("Validate(%q, %q) = %v, want ErrUnknownRideStatus", tt.from, tt.to, err)
+			}
+		})
+	}
+}
+
+func TestRideStateMachineIsTerminal(t *testing.T) {
+	m := NewRideStateMachine()
+	for _, status := range append(allRideStatuses, "", "FLYING") {
+		want := status == RideStatusCompleted || status == RideStatusCanceled
+		if got := m.IsTerminal(status); got != want {
+			t.Errorf("IsTerminal(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestWriteRideTransitionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"unknown status", fmt.Errorf("%w: FLYING", ErrUnknownRideStatus), http.StatusBadRequest},
+		{"illegal transition", &RideTransitionError{From: RideStatusCarrying, To: RideStatusEnroute}, http.StatusConflict},
+		{"wrapped illegal transition", fmt.Errorf("failed: %w", &RideTransitionError{From: RideStatusCompleted, To: RideStatusMatching}), http.StatusConflict},
+		{"other error", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeRideTransitionError(w, tt.err)
+			if w.Code != tt.want {
+				t.Fatalf("status code = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	salesExportFormatCSV   = "csv"
+	salesExportFormatJSONL = "jsonl"
+	// salesExportFlushRows は何行ごとにレスポンスをフラッシュするか
+	salesExportFlushRows  = 500
+	salesExportTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// salesExportRow は売上エクスポートの1行。完了したライド1件に対応する
+type salesExportRow struct {
+	RideID               string    `db:"ride_id" json:"ride_id"`
+	ChairID              string    `db:"chair_id" json:"chair_id"`
+	ChairName            string    `db:"chair_name" json:"chair_name"`
+	Model                string    `db:"model" json:"model"`
+	PickupLatitude       int       `db:"pickup_latitude" json:"pickup_latitude"`
+	PickupLongitude      int       `db:"pickup_longitude" json:"pickup_longitude"`
+	DestinationLatitude  int       `db:"destination_latitude" json:"destination_latitude"`
+	DestinationLongitude int       `db:"destination_longitude" json:"destination_longitude"`
+	Distance             int       `db:"distance" json:"distance"`
+	Fare                 int       `db:"fare" json:"fare"`
+	Discount             int       `db:"discount" json:"discount"`
+	Evaluation           *int      `db:"evaluation" json:"evaluation"`
+	RequestedAt          time.Time `db:"requested_at" json:"-"`
+	CompletedAt          time.Time `db:"completed_at" json:"-"`
+}
+
+var salesExportCSVHeader = []string{
+	"ride_id", "chair_id", "chair_name", "model",
+	"pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude",
+	"distance", "fare", "discount", "evaluation", "requested_at", "completed_at",
+}
+
+func (r *salesExportRow) csvRecord() []string {
+	evaluation := ""
+	if r.Evaluation != nil {
+		evaluation = strconv.Itoa(*r.Evaluation)
+	}
+	return []string{
+		r.RideID, r.ChairID, r.ChairName, r.Model,
+		strconv.Itoa(r.PickupLatitude), strconv.Itoa(r.PickupLongitude),
+		strconv.Itoa(r.DestinationLatitude), strconv.Itoa(r.DestinationLongitude),
+		strconv.Itoa(r.Distance), strconv.Itoa(r.Fare), strconv.Itoa(r.Discount), evaluation,
+		r.RequestedAt.UTC().Format(salesExportTimeFormat), r.CompletedAt.UTC().Format(salesExportTimeFormat),
+	}
+}
+
+func (r *salesExportRow) MarshalJSON() ([]byte, error) {
+	type row salesExportRow
+	return json.Marshal(&struct {
+		*row
+		RequestedAt string `json:"requested_at"`
+		CompletedAt string `json:"completed_at"`
+	}{
+		row:         (*row)(r),
+		RequestedAt: r.RequestedAt.UTC().Format(salesExportTimeFormat),
+		CompletedAt: r.CompletedAt.UTC().Format(salesExportTimeFormat),
+	})
+}
+
+// ownerGetSalesExport は期間内に完了したライドを1行ずつ CSV または JSON Lines で返す
+// 全件をメモリに載せないよう、DBから読みながらレスポンスに書き込む
+func ownerGetSalesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = salesExportFormatCSV
+	}
+	if format != salesExportFormatCSV && format != salesExportFormatJSONL {
+		writeError(w, http.StatusBadRequest, errors.New("format must be one of csv, jsonl"))
+		return
+	}
+
+	since := time.Unix(0, 0)
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if r.URL.Query().Get("until") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = time.UnixMilli(parsed)
+	}
+
+	rows, err := db.QueryxContext(ctx, `
+		SELECT rides.id AS ride_id,
+		       chairs.id AS chair_id,
+		       chairs.name AS chair_name,
+		       chairs.model,
+		       rides.pickup_latitude,
+		       rides.pickup_longitude,
+		       rides.destination_latitude,
+		       rides.destination_longitude,
+		       ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude) AS distance,
+		       COALESCE(ride_fares.final_fare, ? + (ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude)) * ?) AS fare,
+		       COALESCE(ride_fares.coupon_discount, 0) AS discount,
+		       rides.evaluation,
+		       rides.created_at AS requested_at,
+		       ride_statuses.created_at AS completed_at
+		FROM rides
+		JOIN chairs ON chairs.id = rides.chair_id
+		JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+		LEFT JOIN ride_fares ON ride_fares.ride_id = rides.id
+		WHERE rides.owner_id = ? AND ride_statuses.created_at BETWEEN ? AND ?
+		ORDER BY ride_statuses.created_at, rides.id
+	`, initialFare, farePerDistance, owner.ID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to select rides: %w", err))
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("sales-%s.%s", owner.ID, format)
+	switch format {
+	case salesExportFormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case salesExportFormatJSONL:
+		w.Header().Set("Content-Type", "application/jsonl; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	flush := func() error {
+		if format == salesExportFormatCSV {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// ヘッダーを書き込んだ後はステータスコードを変えられないので、エラーはログに残して打ち切る
+	err = func() error {
+		if format == salesExportFormatCSV {
+			if err := csvWriter.Write(salesExportCSVHeader); err != nil {
+				return err
+			}
+		}
+
+		n := 0
+		for rows.Next() {
+			row := &salesExportRow{}
+			if err := rows.StructScan(row); err != nil {
+				return err
+			}
+			switch format {
+			case salesExportFormatCSV:
+				if err := csvWriter.Write(row.csvRecord()); err != nil {
+					return err
+				}
+			case salesExportFormatJSONL:
+				if err := encoder.Encode(row); err != nil {
+					return err
+				}
+			}
+
+			n++
+			if n%salesExportFlushRows == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return flush()
+	}()
+	if err != nil {
+		slog.Error("failed to export sales", "owner_id", owner.ID, "error", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	// 実行環境にタイムゾーンデータが無くても任意のタイムゾーンで集計できるようにする
+	_ "time/tzdata"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// chairSalesBucketSize は chair_sales_buckets の集計単位
+// 30分や45分ずれたタイムゾーンでも時間単位で集計できるよう15分にしている
+const chairSalesBucketSize = 15 * time.Minute
+
+const (
+	salesIntervalHour = "hour"
+	salesIntervalDay  = "day"
+	salesIntervalWeek = "week"
+)
+
+// ChairSalesBucket は椅子ごと・15分ごとの売上の集計
+type ChairSalesBucket struct {
+	OwnerID         string    `db:"owner_id"`
+	ChairID         string    `db:"chair_id"`
+	BucketStart     time.Time `db:"bucket_start"`
+	Sales           int       `db:"sales"`
+	RideCount       int       `db:"ride_count"`
+	EvaluationSum   int       `db:"evaluation_sum"`
+	EvaluationCount int       `db:"evaluation_count"`
+}
+
+// recordChairSales は売上を chair_sales_buckets に加算する
+// ライドの完了時と返金時に呼び出し、集計のたびに rides や ride_statuses を走査しなくて済むようにする
+// 売上はライドが完了した時点の椅子のオーナー(rides.owner_id)に計上する
+func recordChairSales(ctx context.Context, tx *sqlx.Tx, ownerID, chairID string, at time.Time, sales, rideCount int, evaluation *int) error {
+	evaluationSum, evaluationCount := 0, 0
+	if evaluation != nil {
+		evaluationSum, evaluationCount = *evaluation, 1
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO chair_sales_buckets (owner_id, chair_id, bucket_start, sales, ride_count, evaluation_sum, evaluation_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			sales = sales + VALUES(sales),
+			ride_count = ride_count + VALUES(ride_count),
+			evaluation_sum = evaluation_sum + VALUES(evaluation_sum),
+			evaluation_count = evaluation_count + VALUES(evaluation_count)
+	`, ownerID, chairID, at.UTC().Truncate(chairSalesBucketSize), sales, rideCount, evaluationSum, evaluationCount); err != nil {
+		return fmt.Errorf("failed to record chair sales: %w", err)
+	}
+	return nil
+}
+
+type ownerGetSalesTimeseriesResponse struct {
+	Interval string                                 `json:"interval"`
+	Timezone string                                 `json:"timezone"`
+	Chairs   []ownerGetSalesTimeseriesResponseChair `json:"chairs"`
+	Models   []ownerGetSalesTimeseriesResponseModel `json:"models"`
+}
+
+type ownerGetSalesTimeseriesResponseChair struct {
+	ID      string                `json:"id"`
+	Name    string                `json:"name"`
+	Model   string                `json:"model"`
+	Buckets []salesTimeseriesItem `json:"buckets"`
+}
+
+type ownerGetSalesTimeseriesResponseModel struct {
+	Model   string                `json:"model"`
+	Buckets []salesTimeseriesItem `json:"buckets"`
+}
+
+type salesTimeseriesItem struct {
+	Start             int64    `json:"start"`
+	Sales             int      `json:"sales"`
+	RideCount         int      `json:"ride_count"`
+	AverageEvaluation *float64 `json:"average_evaluation"`
+
+	evaluationSum   int
+	evaluationCount int
+}
+
+// salesTimeseries は集計期間の開始時刻ごとの集計
+type salesTimeseries map[int64]*salesTimeseriesItem
+
+func (t salesTimeseries) add(start time.Time, b *ChairSalesBucket) {
+	key := start.UnixMilli()
+	item, ok := t[key]
+	if !ok {
+		item = &salesTimeseriesItem{Start: key}
+		t[key] = item
+	}
+	item.Sales += b.Sales
+	item.RideCount += b.RideCount
+	item.evaluationSum += b.EvaluationSum
+	item.evaluationCount += b.EvaluationCount
+}
+
+// items は開始時刻の昇順に並べた集計を返す
+func (t salesTimeseries) items() []salesTimeseriesItem {
+	items := make([]salesTimeseriesItem, 0, len(t))
+	for _, item := range t {
+		if item.evaluationCount > 0 {
+			avg := float64(item.evaluationSum) / float64(item.evaluationCount)
+			item.AverageEvaluation = &avg
+		}
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Start < items[j].Start })
+	return items
+}
+
+// truncateSalesInterval は t を loc での集計期間の開始時刻に切り捨てる。週は月曜日始まり
+func truncateSalesInterval(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case salesIntervalHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case salesIntervalDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	default:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, loc)
+	}
+}
+
+// ownerGetSalesTimeseries は椅子ごと・モデルごとの売上を一定期間ごとに集計して返す
+// 売上の無い期間は含めない
+// 集計は15分単位なので、since を含む15分の集計から until の直前に始まる15分の集計までを対象にする(until は含まない)
+func ownerGetSalesTimeseries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = salesIntervalDay
+	}
+	if interval != salesIntervalHour && interval != salesIntervalDay && interval != salesIntervalWeek {
+		writeError(w, http.StatusBadRequest, errors.New("interval must be one of hour, day, week"))
+		return
+	}
+
+	timezone := r.URL.Query().Get("timezone")
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timezone: %w", err))
+		return
+	}
+
+	since := time.Unix(0, 0)
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if r.URL.Query().Get("until") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = time.UnixMilli(parsed)
+	}
+
+	chairs, err := selectSalesChairs(ctx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get chairs: %w", err))
+		return
+	}
+
+	buckets := []*ChairSalesBucket{}
+	if err := db.SelectContext(ctx, &buckets,
+		`SELECT * FROM chair_sales_buckets WHERE owner_id = ? AND bucket_start >= ? AND bucket_start < ?`,
+		owner.ID, since.UTC().Truncate(chairSalesBucketSize), until.UTC(),
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to get chair sales: %w", err))
+		return
+	}
+
+	chairSeries := make(map[string]salesTimeseries, len(chairs))
+	modelSeries := map[string]salesTimeseries{}
+	for _, chair := range chairs {
+		chairSeries[chair.ID] = salesTimeseries{}
+		if _, ok := modelSeries[chair.Model]; !ok {
+			modelSeries[chair.Model] = salesTimeseries{}
+		}
+	}
+	chairModels := make(map[string]string, len(chairs))
+	for _, chair := range chairs {
+		chairModels[chair.ID] = chair.Model
+	}
+	for _, b := range buckets {
+		start := truncateSalesInterval(b.BucketStart, interval, loc)
+		chairSeries[b.ChairID].add(start, b)
+		modelSeries[chairModels[b.ChairID]].add(start, b)
+	}
+
+	res := &ownerGetSalesTimeseriesResponse{
+		Interval: interval,
+		Timezone: loc.String(),
+		Chairs:   make([]ownerGetSalesTimeseriesResponseChair, 0, len(chairs)),
+		Models:   make([]ownerGetSalesTimeseriesResponseModel, 0, len(modelSeries)),
+	}
+	for _, chair := range chairs {
+		res.Chairs = append(res.Chairs, ownerGetSalesTimeseriesResponseChair{
+			ID:      chair.ID,
+			Name:    chair.Name,
+			Model:   chair.Model,
+			Buckets: chairSeries[chair.ID].items(),
+		})
+	}
+	for model, series := range modelSeries {
+		res.Models = append(res.Models, ownerGetSalesTimeseriesResponseModel{
+			Model:   model,
+			Buckets: series.items(),
+		})
+	}
+	sort.Slice(res.Models, func(i, j int) bool { return res.Models[i].Model < res.Models[j].Model })
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeatInterval はイベントが無いときにコメント行を送る間隔
+// プロキシがアイドル状態の接続を切断しないようにするためのもの
+const sseHeartbeatInterval = 15 * time.Second
+
+// sseWriter は Server-Sent Events のレスポンスを書き込む
+// 各イベントには ride_statuses.id を id フィールドとして付与し、クライアントが Last-Event-ID で再開できるようにする
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newSSEWriter はSSE用のヘッダーを書き込んでストリームを開始する
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("failed to cast response writer")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &sseWriter{w: w, flusher: flusher}, nil
+}
+
+// Send はIDを付けてイベントを送信し、フラッシュする
+func (s *sseWriter) Send(id string, v interface{}) error {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal json: %w", err)
+	}
+
+	if id != "" {
+		if _, err := fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", jsonData); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Heartbeat はコメント行を送信して接続を維持する
+func (s *sseWriter) Heartbeat() error {
+	if _, err := fmt.Fprint(s.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// lastEventID はクライアントが最後に受け取ったイベントのIDを返す
+func lastEventID(r *http.Request) string {
+	return r.Header.Get("Last-Event-ID")
+}
+
+// selectRideStatusesAfter は lastID のステータスより後に作成されたステータスを古い順に返す
+// 対象のライドは rideCondition (rides を r として参照する条件式) で絞り込む
+// lastID のステータスが存在しない場合は found=false を返す
+func selectRideStatusesAfter(ctx context.Context, lastID string, rideCondition string, args ...interface{}) (statuses []RideStatus, found bool, err error) {
+	last := RideStatus{}
+	if err := db.GetContext(ctx, &last, `SELECT * FROM ride_statuses WHERE id = ?`, lastID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	statuses = []RideStatus{}
+	query := `
+		SELECT rs.*
+		FROM ride_statuses rs
+		JOIN rides r ON r.id = rs.ride_id
+		WHERE ` + rideCondition + ` AND (rs.created_at > ? OR (rs.created_at = ? AND rs.id > ?))
+		ORDER BY rs.created_at, rs.id
+	`
+	args = append(args, last.CreatedAt, last.CreatedAt, last.ID)
+	if err := db.SelectContext(ctx, &statuses, query, args...); err != nil {
+		return nil, false, err
+	}
+	return statuses, true, nil
+}
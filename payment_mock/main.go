@@ -2,28 +2,307 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 var (
-	data          = map[string][]int{}
-	dataLock      sync.Mutex
-	responseCache = make(map[string][]ResponsePayment)
-	client        = &http.Client{Timeout: 10 * time.Second}
+	store  = newPaymentStore()
+	faults = newFaultInjector()
+
+	errPaymentNotFound = errors.New("返金する決済が見つかりません")
+	errRefundExceeds   = errors.New("返金額が決済額を超えています")
 )
 
 func main() {
+	if err := faults.loadEnv(); err != nil {
+		slog.Error("failed to load fault config", "error", err)
+		os.Exit(1)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /payments", handleGetPayments)
 	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("POST /refunds", handlePostRefunds)
+
+	// テスト用の管理API
+	mux.HandleFunc("POST /admin/reset", handleAdminReset)
+	mux.HandleFunc("GET /admin/payments", handleAdminGetPayments)
+	mux.HandleFunc("GET /admin/faults", handleAdminGetFaults)
+	mux.HandleFunc("PUT /admin/faults", handleAdminPutFaults)
+
 	http.ListenAndServe(":12345", mux)
 }
 
+type Payment struct {
+	Token          string    `json:"token"`
+	Amount         int       `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type Refund struct {
+	Token                 string    `json:"token"`
+	PaymentIdempotencyKey string    `json:"payment_idempotency_key"`
+	Amount                int       `json:"amount"`
+	IdempotencyKey        string    `json:"idempotency_key,omitempty"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+type idempotencyEntry struct {
+	amount     int
+	inProgress bool
+}
+
+// paymentStore は決済の記録と冪等キーを保持する
+type paymentStore struct {
+	mutex    sync.Mutex
+	payments map[string][]Payment
+	refunds  map[string][]Refund
+	keys     map[string]*idempotencyEntry
+}
+
+func newPaymentStore() *paymentStore {
+	return &paymentStore{
+		payments: map[string][]Payment{},
+		refunds:  map[string][]Refund{},
+		keys:     map[string]*idempotencyEntry{},
+	}
+}
+
+type beginResult int
+
+const (
+	beginNew beginResult = iota
+	beginReplay
+	beginInProgress
+	beginMismatch
+)
+
+// begin は冪等キーの処理を開始する。キーが無い場合は常に新しい決済として扱う
+func (s *paymentStore) begin(token, key string, amount int) beginResult {
+	if key == "" {
+		return beginNew
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.keys[token+"\x00"+key]
+	if !ok {
+		s.keys[token+"\x00"+key] = &idempotencyEntry{amount: amount, inProgress: true}
+		return beginNew
+	}
+	switch {
+	case entry.inProgress:
+		return beginInProgress
+	case entry.amount != amount:
+		return beginMismatch
+	default:
+		return beginReplay
+	}
+}
+
+// finish は決済の処理を終える。recorded が false なら同じキーで再送できるようにキーを忘れる
+func (s *paymentStore) finish(token, key string, amount int, recorded bool) {
+	if recorded {
+		s.mutex.Lock()
+		s.payments[token] = append(s.payments[token], Payment{
+			Token:          token,
+			Amount:         amount,
+			IdempotencyKey: key,
+			CreatedAt:      time.Now(),
+		})
+		s.mutex.Unlock()
+		s.complete(token, key)
+	} else {
+		s.forget(token, key)
+	}
+}
+
+// complete はキーの処理が終わったことを記録し、以降の同じキーの要求を再送として扱う
+func (s *paymentStore) complete(token, key string) {
+	if key == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry, ok := s.keys[token+"\x00"+key]; ok {
+		entry.inProgress = false
+	}
+}
+
+// forget はキーを忘れ、同じキーで再送できるようにする
+func (s *paymentStore) forget(token, key string) {
+	if key == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.keys, token+"\x00"+key)
+}
+
+// refund は冪等キー paymentKey で行った決済を amount だけ返金する
+// 決済が見つからなければ errPaymentNotFound、返金額が残額を超えれば errRefundExceeds を返す
+func (s *paymentStore) refund(token, paymentKey, key string, amount int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paid := -1
+	for _, p := range s.payments[token] {
+		if paymentKey != "" && p.IdempotencyKey == paymentKey {
+			paid = p.Amount
+			break
+		}
+	}
+	if paid < 0 {
+		return errPaymentNotFound
+	}
+	for _, r := range s.refunds[token] {
+		if r.PaymentIdempotencyKey == paymentKey {
+			paid -= r.Amount
+		}
+	}
+	if amount > paid {
+		return errRefundExceeds
+	}
+
+	s.refunds[token] = append(s.refunds[token], Refund{
+		Token:                 token,
+		PaymentIdempotencyKey: paymentKey,
+		Amount:                amount,
+		IdempotencyKey:        key,
+		CreatedAt:             time.Now(),
+	})
+	return nil
+}
+
+func (s *paymentStore) list(token string) []Payment {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]Payment{}, s.payments[token]...)
+}
+
+func (s *paymentStore) all() ([]Payment, []Refund) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	payments := []Payment{}
+	for _, p := range s.payments {
+		payments = append(payments, p...)
+	}
+	refunds := []Refund{}
+	for _, r := range s.refunds {
+		refunds = append(refunds, r...)
+	}
+	return payments, refunds
+}
+
+func (s *paymentStore) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.payments = map[string][]Payment{}
+	s.refunds = map[string][]Refund{}
+	s.keys = map[string]*idempotencyEntry{}
+}
+
+// FaultConfig は POST /payments に注入する障害の設定
+// 各 Rate は 0〜1 の確率
+type FaultConfig struct {
+	// ErrorRate の確率で決済せずに500を返す
+	ErrorRate float64 `json:"error_rate"`
+	// SucceedButFailRate の確率で決済したうえで500を返す
+	SucceedButFailRate float64 `json:"succeed_but_fail_rate"`
+	// TooManyRequestsRate の確率で決済せずに429を返す
+	TooManyRequestsRate float64 `json:"too_many_requests_rate"`
+	// LatencyMs だけ応答を遅らせる。LatencyJitterMs が指定されていればその範囲でばらつかせる
+	LatencyMs       int `json:"latency_ms"`
+	LatencyJitterMs int `json:"latency_jitter_ms"`
+}
+
+type faultInjector struct {
+	mutex  sync.RWMutex
+	config FaultConfig
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{}
+}
+
+// loadEnv は環境変数から障害の設定を読み込む
+func (f *faultInjector) loadEnv() error {
+	config := FaultConfig{}
+	floats := map[string]*float64{
+		"PAYMENT_MOCK_ERROR_RATE":             &config.ErrorRate,
+		"PAYMENT_MOCK_SUCCEED_BUT_FAIL_RATE":  &config.SucceedButFailRate,
+		"PAYMENT_MOCK_TOO_MANY_REQUESTS_RATE": &config.TooManyRequestsRate,
+	}
+	for name, dest := range floats {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*dest = n
+		}
+	}
+	ints := map[string]*int{
+		"PAYMENT_MOCK_LATENCY_MS":        &config.LatencyMs,
+		"PAYMENT_MOCK_LATENCY_JITTER_MS": &config.LatencyJitterMs,
+	}
+	for name, dest := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*dest = n
+		}
+	}
+	return f.set(config)
+}
+
+func (f *faultInjector) set(config FaultConfig) error {
+	for _, rate := range []float64{config.ErrorRate, config.SucceedButFailRate, config.TooManyRequestsRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("rate must be between 0 and 1: %v", rate)
+		}
+	}
+	if config.LatencyMs < 0 || config.LatencyJitterMs < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.config = config
+	return nil
+}
+
+func (f *faultInjector) get() FaultConfig {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.config
+}
+
+func (f *faultInjector) latency() time.Duration {
+	config := f.get()
+	ms := config.LatencyMs
+	if config.LatencyJitterMs > 0 {
+		ms += rand.IntN(config.LatencyJitterMs + 1)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 type PostPaymentsRequest struct {
 	Amount int `json:"amount"`
 }
@@ -46,58 +325,173 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ロック範囲を縮小
-	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	if d := faults.latency(); d > 0 {
+		time.Sleep(d)
 	}
-	dataLock.Unlock()
 
-	// ここで配列を更新
-	arr = append(arr, req.Amount)
+	config := faults.get()
+	if rand.Float64() < config.TooManyRequestsRate {
+		writeError(w, http.StatusTooManyRequests, "リクエストが多すぎます")
+		return
+	}
 
+	key := r.Header.Get("Idempotency-Key")
+	switch store.begin(token, key, req.Amount) {
+	case beginReplay:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case beginInProgress:
+		writeError(w, http.StatusConflict, "同じkeyでの決済が実行中です")
+		return
+	case beginMismatch:
+		writeError(w, http.StatusUnprocessableEntity, "同じkeyで異なる決済が要求されました")
+		return
+	}
+
+	if rand.Float64() < config.ErrorRate {
+		store.finish(token, key, req.Amount, false)
+		writeError(w, http.StatusInternalServerError, "決済に失敗しました")
+		return
+	}
+
+	store.finish(token, key, req.Amount, true)
 	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
+
+	if rand.Float64() < config.SucceedButFailRate {
+		writeError(w, http.StatusInternalServerError, "決済に失敗しました")
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+type PostRefundsRequest struct {
+	PaymentIdempotencyKey string `json:"payment_idempotency_key"`
+	Amount                int    `json:"amount"`
 }
 
-func handleGetPayments(w http.ResponseWriter, r *http.Request) {
+func handlePostRefunds(w http.ResponseWriter, r *http.Request) {
 	token, err := getTokenFromAuthorizationHeader(r)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// キャッシュを確認
-	if cachedResponse, exists := responseCache[token]; exists {
-		writeJSON(w, http.StatusOK, cachedResponse)
+	var req PostRefundsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエスト形式です")
+		return
+	}
+	if req.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, "返金額が不正です")
+		return
+	}
+
+	if d := faults.latency(); d > 0 {
+		time.Sleep(d)
+	}
+
+	config := faults.get()
+	if rand.Float64() < config.TooManyRequestsRate {
+		writeError(w, http.StatusTooManyRequests, "リクエストが多すぎます")
+		return
+	}
+
+	// 決済とは別の名前空間で冪等キーを管理する
+	key := r.Header.Get("Idempotency-Key")
+	storeKey := ""
+	if key != "" {
+		storeKey = "refund:" + key
+	}
+	switch store.begin(token, storeKey, req.Amount) {
+	case beginReplay:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case beginInProgress:
+		writeError(w, http.StatusConflict, "同じkeyでの返金が実行中です")
+		return
+	case beginMismatch:
+		writeError(w, http.StatusUnprocessableEntity, "同じkeyで異なる返金が要求されました")
+		return
+	}
+
+	if rand.Float64() < config.ErrorRate {
+		store.forget(token, storeKey)
+		writeError(w, http.StatusInternalServerError, "返金に失敗しました")
+		return
+	}
+
+	if err := store.refund(token, req.PaymentIdempotencyKey, key, req.Amount); err != nil {
+		store.forget(token, storeKey)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store.complete(token, storeKey)
+	slog.Info("返金完了", slog.String("token", token), slog.Int("amount", req.Amount))
+
+	if rand.Float64() < config.SucceedButFailRate {
+		writeError(w, http.StatusInternalServerError, "返金に失敗しました")
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// データをロックして取得
-	dataLock.Lock()
-	arr, _ := data[token]
-	dataLock.Unlock()
+type ResponsePayment struct {
+	Amount int    `json:"amount"`
+	Status string `json:"status"`
+}
+
+func handleGetPayments(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
+	payments := store.list(token)
+	res := make([]ResponsePayment, 0, len(payments))
+	for _, p := range payments {
 		res = append(res, ResponsePayment{
-			Amount: amount,
+			Amount: p.Amount,
 			Status: "成功",
 		})
 	}
 
-	responseCache[token] = res
-
 	writeJSON(w, http.StatusOK, res)
 }
 
+// handleAdminReset は記録した決済と冪等キーを全て消す
+func handleAdminReset(w http.ResponseWriter, r *http.Request) {
+	store.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminGetPayments は記録した全ての決済と返金を返す
+func handleAdminGetPayments(w http.ResponseWriter, r *http.Request) {
+	payments, refunds := store.all()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"payments": payments,
+		"refunds":  refunds,
+	})
+}
+
+func handleAdminGetFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, faults.get())
+}
+
+// handleAdminPutFaults は注入する障害の設定を置き換える
+func handleAdminPutFaults(w http.ResponseWriter, r *http.Request) {
+	var config FaultConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエスト形式です")
+		return
+	}
+	if err := faults.set(config); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, faults.get())
+}
+
 func getTokenFromAuthorizationHeader(r *http.Request) (string, error) {
 	auth := r.Header.Get("Authorization")
 	if !strings.HasPrefix(auth, "Bearer ") {
@@ -17,10 +17,21 @@ CREATE TABLE chair_models
 (
   name  VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
   speed INTEGER     NOT NULL COMMENT '移動速度',
+  tier  VARCHAR(30) NOT NULL DEFAULT 'standard' COMMENT '料金ティア',
   PRIMARY KEY (name)
 )
   COMMENT = '椅子モデルテーブル';
 
+DROP TABLE IF EXISTS pricing_tiers;
+CREATE TABLE pricing_tiers
+(
+  name              VARCHAR(30) NOT NULL COMMENT '料金ティア',
+  base_fare         INTEGER     NOT NULL COMMENT '初乗り運賃',
+  fare_per_distance INTEGER     NOT NULL COMMENT '距離あたりの運賃',
+  PRIMARY KEY (name)
+)
+  COMMENT = '椅子モデルのティアごとの料金テーブル';
+
 DROP TABLE IF EXISTS chairs;
 CREATE TABLE chairs
 (
@@ -99,7 +110,7 @@ CREATE TABLE ride_statuses
 (
   id              VARCHAR(26)                                                                NOT NULL,
   ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
   created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
   app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
   chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
@@ -107,6 +118,136 @@ CREATE TABLE ride_statuses
 )
   COMMENT = 'ライドステータスの変更履歴テーブル';
 
+DROP TABLE IF EXISTS price_quotes;
+CREATE TABLE price_quotes
+(
+  id                    VARCHAR(26)  NOT NULL COMMENT '見積もりID',
+  user_id               VARCHAR(26)  NOT NULL COMMENT 'ユーザーID',
+  tier                  VARCHAR(30)  NULL COMMENT '指定された料金ティア、NULL ならどの椅子でもよい',
+  pickup_latitude       INTEGER      NOT NULL COMMENT '配車位置(経度)',
+  pickup_longitude      INTEGER      NOT NULL COMMENT '配車位置(緯度)',
+  destination_latitude  INTEGER      NOT NULL COMMENT '目的地(経度)',
+  destination_longitude INTEGER      NOT NULL COMMENT '目的地(緯度)',
+  base_fare             INTEGER      NOT NULL COMMENT '初乗り運賃',
+  fare_per_distance     INTEGER      NOT NULL COMMENT '距離あたりの運賃',
+  surge_multiplier      DECIMAL(4,2) NOT NULL COMMENT 'サージ倍率',
+  metered_fare          INTEGER      NOT NULL COMMENT '距離に応じた運賃(サージ適用後)',
+  fare                  INTEGER      NOT NULL COMMENT '割引前の運賃',
+  ride_id               VARCHAR(26)  NULL COMMENT 'この見積もりで確定したライドのID',
+  expires_at            DATETIME(6)  NOT NULL COMMENT '有効期限',
+  created_at            DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  UNIQUE (ride_id)
+)
+  COMMENT = 'ライドの運賃の見積もりテーブル';
+
+DROP TABLE IF EXISTS ride_fares;
+CREATE TABLE ride_fares
+(
+  ride_id          VARCHAR(26)  NOT NULL COMMENT 'ライドID',
+  base_fare        INTEGER      NOT NULL COMMENT '初乗り運賃',
+  metered_fare     INTEGER      NOT NULL COMMENT '距離に応じた運賃(サージ適用後)',
+  surge_multiplier DECIMAL(4,2) NOT NULL COMMENT 'サージ倍率',
+  coupon_code      VARCHAR(255) NULL COMMENT '適用したクーポンのコード',
+  coupon_discount  INTEGER      NOT NULL COMMENT 'クーポンによる割引額',
+  final_fare       INTEGER      NOT NULL COMMENT '利用者が支払う運賃',
+  currency         VARCHAR(3)   NOT NULL COMMENT '通貨',
+  finalized_at     DATETIME(6)  NULL COMMENT 'ライドの完了またはキャンセルで確定した日時',
+  created_at       DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at       DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドの運賃の内訳テーブル';
+
+DROP TABLE IF EXISTS chair_sales_buckets;
+CREATE TABLE chair_sales_buckets
+(
+  owner_id         VARCHAR(26) NOT NULL COMMENT '売上を計上したオーナーID',
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  bucket_start     DATETIME    NOT NULL COMMENT '集計期間(15分)の開始日時(UTC)',
+  sales            INTEGER     NOT NULL COMMENT '売上(返金を差し引いた額)',
+  ride_count       INTEGER     NOT NULL COMMENT '完了したライドの数',
+  evaluation_sum   INTEGER     NOT NULL COMMENT '評価の合計',
+  evaluation_count INTEGER     NOT NULL COMMENT '評価の数',
+  PRIMARY KEY (owner_id, chair_id, bucket_start)
+)
+  COMMENT = '椅子ごとの売上の集計テーブル';
+
+DROP TABLE IF EXISTS ride_cancellations;
+CREATE TABLE ride_cancellations
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  fee        INTEGER     NOT NULL COMMENT 'キャンセル料',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT 'キャンセル日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドのキャンセル情報テーブル';
+
+DROP TABLE IF EXISTS ride_declines;
+CREATE TABLE ride_declines
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '辞退した椅子ID',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '辞退日時',
+  PRIMARY KEY (ride_id, chair_id)
+)
+  COMMENT = '椅子がライドを辞退した記録テーブル';
+
+DROP TABLE IF EXISTS payments;
+CREATE TABLE payments
+(
+  ride_id          VARCHAR(26)                                        NOT NULL COMMENT 'ライドID',
+  user_id          VARCHAR(26)                                        NOT NULL COMMENT 'ユーザーID',
+  amount           INTEGER                                            NOT NULL COMMENT '決済額',
+  idempotency_key  VARCHAR(26)                                        NOT NULL COMMENT '決済マイクロサービスに送る冪等キー',
+  payment_token_id VARCHAR(26)                                        NULL COMMENT '最後に使った決済手段のID',
+  status           ENUM ('pending', 'succeeded', 'failed', 'unknown') NOT NULL COMMENT '決済状態',
+  last_error       TEXT                                               NULL COMMENT '最後に発生したエラー',
+  created_at       DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at       DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドごとの決済台帳テーブル';
+
+DROP TABLE IF EXISTS payment_jobs;
+CREATE TABLE payment_jobs
+(
+  id              VARCHAR(26)                                        NOT NULL COMMENT '決済要求ID',
+  ride_id         VARCHAR(26)                                        NOT NULL COMMENT 'ライドID',
+  user_id         VARCHAR(26)                                        NOT NULL COMMENT 'ユーザーID',
+  amount          INTEGER                                            NOT NULL COMMENT '決済額',
+  status          ENUM ('queued', 'processing', 'succeeded', 'dead') NOT NULL COMMENT '配信状態',
+  attempts        INTEGER                                            NOT NULL DEFAULT 0 COMMENT '配信を試みた回数',
+  next_attempt_at DATETIME(6)                                        NOT NULL COMMENT '次に配信を試みる日時',
+  last_error      TEXT                                               NULL COMMENT '最後に発生したエラー',
+  created_at      DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (ride_id)
+)
+  COMMENT = '決済マイクロサービスへ配信する決済要求のアウトボックステーブル';
+
+DROP TABLE IF EXISTS refunds;
+CREATE TABLE refunds
+(
+  id              VARCHAR(26)                                        NOT NULL COMMENT '返金ID',
+  ride_id         VARCHAR(26)                                        NOT NULL COMMENT 'ライドID',
+  amount          INTEGER                                            NOT NULL COMMENT '返金額(負の値)',
+  reason          TEXT                                               NOT NULL COMMENT '返金理由',
+  requested_by    VARCHAR(26)                                        NOT NULL COMMENT '返金を要求したオーナーのID、運営の場合は operator',
+  idempotency_key VARCHAR(26)                                        NOT NULL COMMENT '決済マイクロサービスに送る冪等キー',
+  status          ENUM ('pending', 'succeeded', 'failed', 'unknown') NOT NULL COMMENT '返金状態',
+  coupon_code     VARCHAR(255)                                       NULL COMMENT '返金に伴って付与したクーポンのコード',
+  coupon_discount INTEGER                                            NOT NULL DEFAULT 0 COMMENT '返金が成功したら付与するクーポンの割引額',
+  attempts        INTEGER                                            NOT NULL DEFAULT 0 COMMENT '決済マイクロサービスへ返金を要求した回数',
+  next_attempt_at DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '結果が分からない返金を次に再送する日時',
+  last_error      TEXT                                               NULL COMMENT '最後に発生したエラー',
+  created_at      DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '決済の返金テーブル';
+
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
 (
@@ -135,12 +276,68 @@ CREATE TABLE coupons
 )
   COMMENT 'クーポンテーブル';
 
+DROP TABLE IF EXISTS invitations;
+CREATE TABLE invitations
+(
+  invitee_id      VARCHAR(26)  NOT NULL COMMENT '招待されたユーザーのID',
+  inviter_id      VARCHAR(26)  NOT NULL COMMENT '招待したユーザーのID',
+  invitation_code VARCHAR(30)  NOT NULL COMMENT '使われた招待コード',
+  reward_amount   INTEGER      NULL COMMENT '招待したユーザーに付与した特典の割引額',
+  reward_code     VARCHAR(255) NULL COMMENT '招待したユーザーに付与したクーポンのコード',
+  rewarded_at     DATETIME(6)  NULL COMMENT '招待したユーザーに特典を付与した日時',
+  created_at      DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (invitee_id)
+)
+  COMMENT '招待コードを使った登録の記録テーブル';
+
+DROP TABLE IF EXISTS coupon_definitions;
+CREATE TABLE coupon_definitions
+(
+  name            VARCHAR(30)              NOT NULL COMMENT 'クーポンの種類',
+  type            ENUM ('flat', 'percent') NOT NULL COMMENT '割引方法',
+  percent         INTEGER                  NULL COMMENT '割引率(percent の場合)',
+  max_discount    INTEGER                  NULL COMMENT '割引額の上限',
+  min_fare        INTEGER                  NOT NULL DEFAULT 0 COMMENT '適用に必要な割引前の運賃',
+  expires_at      DATETIME(6)              NULL COMMENT 'この種類のクーポンを適用できる期限',
+  first_ride_only TINYINT(1)               NOT NULL DEFAULT 0 COMMENT '初回のライドにだけ適用できるかどうか',
+  max_uses        INTEGER                  NULL COMMENT 'ユーザーごとの利用回数の上限',
+  valid_days      INTEGER                  NULL COMMENT '付与してからクーポンを使える日数',
+  description     TEXT                     NOT NULL COMMENT '説明',
+  PRIMARY KEY (name)
+)
+  COMMENT 'クーポンの種類ごとの適用ルールテーブル';
+
+DROP TABLE IF EXISTS chair_register_tokens;
+CREATE TABLE chair_register_tokens
+(
+  id             VARCHAR(26)  NOT NULL COMMENT '登録トークンID',
+  owner_id       VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  name           VARCHAR(30)  NOT NULL COMMENT '登録トークン名',
+  token          VARCHAR(255) NOT NULL COMMENT '椅子登録トークン',
+  allowed_models TEXT         NULL COMMENT '登録を許可する椅子のモデル(JSON配列)。NULLなら制限しない',
+  max_uses       INTEGER      NULL COMMENT '登録できる椅子の数の上限',
+  uses           INTEGER      NOT NULL DEFAULT 0 COMMENT '登録した椅子の数',
+  expires_at     DATETIME(6)  NULL COMMENT '有効期限',
+  revoked_at     DATETIME(6)  NULL COMMENT '無効にした日時',
+  created_at     DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  UNIQUE (token)
+)
+  COMMENT 'オーナーが発行した椅子登録トークンテーブル';
+
 
 CREATE INDEX idx_users_access_token ON users(access_token);
 CREATE INDEX idx_chairs_is_active ON chairs(is_active);
 CREATE INDEX idx_chairs_owner_id ON chairs(owner_id);
 CREATE INDEX idx_ride_statuses_ride_id_created_at ON ride_statuses(ride_id, created_at DESC);
 CREATE INDEX idx_rides_user_id ON rides(user_id);
+CREATE INDEX idx_payments_user_id ON payments(user_id);
+CREATE INDEX idx_payments_status ON payments(status);
+CREATE INDEX idx_refunds_ride_id ON refunds(ride_id);
+CREATE INDEX idx_refunds_status_next_attempt_at ON refunds(status, next_attempt_at);
+CREATE INDEX idx_invitations_inviter_id ON invitations(inviter_id);
+CREATE INDEX idx_chair_register_tokens_owner_id ON chair_register_tokens(owner_id);
+CREATE INDEX idx_payment_jobs_status_next_attempt_at ON payment_jobs(status, next_attempt_at);
 CREATE INDEX idx_rides_chair_id ON rides(chair_id);
 CREATE INDEX idx_chair_locations_chair_id_created_at ON chair_locations(chair_id, created_at DESC);
 CREATE INDEX idx_ride_statuses_ride_id_status ON ride_statuses(ride_id, status);
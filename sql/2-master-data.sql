@@ -4,7 +4,25 @@ SET CHARACTER_SET_CONNECTION = utf8mb4;
 USE isuride;
 
 INSERT INTO settings (name, value)
-VALUES ('payment_gateway_url', 'http://localhost:12345');
+VALUES ('payment_gateway_url', 'http://localhost:12345'),
+       ('matching_policy', 'eta'),
+       ('referral_max_invites', '3'),
+       ('referral_invitee_reward', '1500'),
+       ('referral_inviter_reward', '1000'),
+       ('referral_reward_on', 'signup'),
+       ('pricing_surge_max_multiplier', '2.0');
+
+INSERT INTO pricing_tiers (name, base_fare, fare_per_distance)
+VALUES ('economy', 400, 80),
+       ('standard', 500, 100),
+       ('premium', 800, 150);
+
+INSERT INTO coupon_definitions (name, type, percent, max_discount, min_fare, expires_at, first_ride_only, max_uses, valid_days, description)
+VALUES ('CP_NEW2024', 'flat', NULL, NULL, 0, NULL, 0, 1, NULL, '初回登録キャンペーン'),
+       ('INV', 'flat', NULL, NULL, 0, NULL, 0, NULL, NULL, '招待されたユーザーへの特典'),
+       ('RWD', 'flat', NULL, NULL, 0, NULL, 0, NULL, NULL, '招待したユーザーへの特典'),
+       ('RF', 'flat', NULL, NULL, 0, NULL, 0, NULL, 180, '返金に伴う補填'),
+       ('flat', 'flat', NULL, NULL, 0, NULL, 0, NULL, NULL, '定額割引');
 
 INSERT INTO chair_models (name, speed)
 VALUES ('リラックスシート NEO', 2),
@@ -62,3 +80,7 @@ VALUES ('リラックスシート NEO', 2),
        ('タイタンフレーム ULTRA', 7),
        ('ヴァーチェア SUPREME', 7),
        ('オブシディアン PRIME', 7);
+
+-- 速度の遅いモデルは安く、速いモデルは高い料金ティアにする
+UPDATE chair_models SET tier = 'economy' WHERE speed <= 2;
+UPDATE chair_models SET tier = 'premium' WHERE speed >= 7;
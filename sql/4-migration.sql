@@ -0,0 +1,115 @@
+-- 初期データ(3-initial-data.sql.gz)は列を指定せずに INSERT しているので、
+-- 既存テーブルの列の追加・変更は初期データを投入した後にここで行う
+
+SET CHARACTER_SET_CLIENT = utf8mb4;
+SET CHARACTER_SET_CONNECTION = utf8mb4;
+
+USE isuride;
+
+-- 決済手段を複数登録できるようにする
+-- 既存の決済トークンはユーザーごとに1つなので、ユーザーIDをそのままIDとして使う
+ALTER TABLE payment_tokens
+  ADD COLUMN id         VARCHAR(26) NOT NULL DEFAULT '' COMMENT '決済手段ID' FIRST,
+  ADD COLUMN is_default TINYINT(1)  NOT NULL DEFAULT 0 COMMENT '既定の決済手段かどうか' AFTER token;
+UPDATE payment_tokens SET id = user_id, is_default = 1;
+ALTER TABLE payment_tokens
+  ALTER COLUMN id DROP DEFAULT,
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (id),
+  ADD UNIQUE (user_id, token);
+
+-- クーポンに適用ルール(coupon_definitions)を紐づける
+ALTER TABLE coupons
+  ADD COLUMN definition VARCHAR(30) NOT NULL DEFAULT 'flat' COMMENT 'クーポンの種類' AFTER discount;
+UPDATE coupons SET definition = 'CP_NEW2024' WHERE code = 'CP_NEW2024';
+UPDATE coupons SET definition = 'INV' WHERE code LIKE 'INV\_%';
+UPDATE coupons SET definition = 'RWD' WHERE code LIKE 'RWD\_%';
+UPDATE coupons SET definition = 'RF' WHERE code LIKE 'RF\_%';
+
+-- クーポンに有効期限を設ける。期限切れの判定は CouponSweeper が定期的に expired_at に記録する
+ALTER TABLE coupons
+  ADD COLUMN expires_at DATETIME(6) NULL COMMENT '有効期限',
+  ADD COLUMN expired_at DATETIME(6) NULL COMMENT '期限切れとして処理した日時';
+CREATE INDEX idx_coupons_expires_at ON coupons(expires_at);
+
+-- 初期データの招待クーポンから招待の記録を作る。初期データでは登録時に特典を付与している
+INSERT INTO invitations (invitee_id, inviter_id, invitation_code, reward_amount, rewarded_at, created_at)
+SELECT coupons.user_id, users.id, users.invitation_code, 1000, coupons.created_at, coupons.created_at
+FROM coupons
+JOIN users ON users.invitation_code = SUBSTRING(coupons.code, 5)
+WHERE coupons.code LIKE 'INV\_%';
+
+-- 初期データのライドの運賃の内訳を作る。初期データは標準の運賃で、クーポンは全て定額割引
+INSERT INTO ride_fares (ride_id, base_fare, metered_fare, surge_multiplier, coupon_code, coupon_discount, final_fare, currency, finalized_at, created_at)
+SELECT r.id,
+       500,
+       r.metered_fare,
+       1,
+       coupons.code,
+       LEAST(COALESCE(coupons.discount, 0), r.metered_fare),
+       500 + GREATEST(r.metered_fare - COALESCE(coupons.discount, 0), 0),
+       'JPY',
+       (SELECT MAX(rs.created_at) FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status IN ('COMPLETED', 'CANCELED')),
+       r.created_at
+FROM (
+  SELECT id, created_at, (ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude)) * 100 AS metered_fare
+  FROM rides
+) r
+LEFT JOIN coupons ON coupons.used_by = r.id;
+
+-- 初期データの完了したライドと返金から売上の集計を作る。初期データでは椅子のオーナーは変わっていない
+INSERT INTO chair_sales_buckets (owner_id, chair_id, bucket_start, sales, ride_count, evaluation_sum, evaluation_count)
+SELECT chairs.owner_id, chair_id, bucket_start, SUM(sales), SUM(ride_count), SUM(evaluation_sum), SUM(evaluation_count)
+FROM (
+  SELECT rides.chair_id,
+         FROM_UNIXTIME(FLOOR(UNIX_TIMESTAMP(rides.updated_at) / 900) * 900) AS bucket_start,
+         ride_fares.final_fare AS sales,
+         1 AS ride_count,
+         COALESCE(rides.evaluation, 0) AS evaluation_sum,
+         IF(rides.evaluation IS NULL, 0, 1) AS evaluation_count
+  FROM rides
+  JOIN ride_fares ON ride_fares.ride_id = rides.id
+  WHERE rides.chair_id IS NOT NULL
+  AND EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status = 'COMPLETED')
+  UNION ALL
+  SELECT rides.chair_id,
+         FROM_UNIXTIME(FLOOR(UNIX_TIMESTAMP(refunds.created_at) / 900) * 900),
+         refunds.amount,
+         0,
+         0,
+         0
+  FROM refunds
+  JOIN rides ON rides.id = refunds.ride_id
+  WHERE rides.chair_id IS NOT NULL AND refunds.status = 'succeeded'
+) s
+JOIN chairs ON chairs.id = s.chair_id
+GROUP BY chairs.owner_id, chair_id, bucket_start;
+
+-- オーナーが引退させた椅子を記録する
+ALTER TABLE chairs
+  ADD COLUMN retired_at DATETIME(6) NULL COMMENT '引退させた日時';
+
+-- 椅子を登録した登録トークンを記録する
+ALTER TABLE chairs
+  ADD COLUMN chair_register_token_id VARCHAR(26) NULL COMMENT '登録に使った椅子登録トークンID';
+
+-- 既存のオーナーの椅子登録トークンを、オーナーIDをIDとする default の登録トークンとして移す
+INSERT INTO chair_register_tokens (id, owner_id, name, token, uses, created_at)
+SELECT owners.id, owners.id, 'default', owners.chair_register_token,
+       (SELECT COUNT(*) FROM chairs WHERE chairs.owner_id = owners.id),
+       owners.created_at
+FROM owners;
+UPDATE chairs SET chair_register_token_id = owner_id;
+
+-- オーナーが配車受付を停止させた椅子を記録する。オーナーが解除するまで椅子は自分で受付を再開できない
+ALTER TABLE chairs
+  ADD COLUMN owner_disabled_at DATETIME(6) NULL COMMENT 'オーナーが配車受付を停止させた日時';
+
+-- 売上はライドが完了した時点の椅子のオーナーに計上する。椅子を譲渡しても過去の売上は元のオーナーに残る
+ALTER TABLE rides
+  ADD COLUMN owner_id VARCHAR(26) NULL COMMENT '売上を計上したオーナーID';
+UPDATE rides
+JOIN chairs ON chairs.id = rides.chair_id
+SET rides.owner_id = chairs.owner_id
+WHERE EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = rides.id AND rs.status = 'COMPLETED');
+CREATE INDEX idx_rides_owner_id ON rides(owner_id);